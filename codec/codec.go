@@ -0,0 +1,219 @@
+package codec
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+)
+
+/**
+Compression codecs of the intermediate and output files.
+
+A compressed file starts with the header Magic, the length of the codec name as a byte and the
+name, followed by the stream of the codec. Readers find the codec from the header, a file
+without the header is read as is. Files written with None have no header, they are identical
+to the files written before codecs existed.
+
+The streams of a NativeCodec, e.g. gzip, start with a magic number of their own. They are
+written without the header, readers detect them by their magic, and the usual tools of their
+format, e.g. zcat, read them.
+*/
+
+/**
+Compresses and decompresses a stream.
+*/
+type Codec interface {
+	//Close of the returned writer ends the compressed stream, w stays open
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+/**
+A codec whose streams start with a magic number of their own.
+*/
+type NativeCodec interface {
+	Codec
+	Magic() []byte
+}
+
+const (
+	None  = "none"
+	Gzip  = "gzip"
+	Flate = "flate"
+
+	DefaultCodec = None
+
+	Magic = "GMRZ"
+)
+
+/**
+Returned for a codec which is not registered.
+*/
+var ErrUnknown = errors.New("unknown codec")
+
+var (
+	mx     sync.RWMutex
+	codecs = map[string]Codec{
+		Gzip:  gzipCodec{},
+		Flate: flateCodec{},
+	}
+)
+
+/**
+Registers a codec under the name, e.g. in the init function of a plugin. The workers reading
+its files need the codec as well.
+*/
+func Register(name string, codec Codec) error {
+	mx.Lock()
+	defer mx.Unlock()
+	if name == "" || name == None || len(name) > 255 {
+		return fmt.Errorf("invalid codec name: %q", name)
+	}
+	if _, ok := codecs[name]; ok {
+		return fmt.Errorf("the codec %q is already registered", name)
+	}
+	codecs[name] = codec
+	return nil
+}
+
+/**
+Returns the codec with the given name, nil for None or "".
+*/
+func Lookup(name string) (Codec, error) {
+	if name == "" || name == None {
+		return nil, nil
+	}
+	mx.RLock()
+	codec, ok := codecs[name]
+	mx.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %q, available: %s", ErrUnknown, name, strings.Join(Names(), ", "))
+	}
+	return codec, nil
+}
+
+func Names() []string {
+	mx.RLock()
+	defer mx.RUnlock()
+	names := []string{None}
+	for name := range codecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+/**
+Returns a writer compressing into w with the named codec. Close ends the compressed stream,
+w stays open.
+*/
+func NewWriter(w io.Writer, name string) (io.WriteCloser, error) {
+	codec, err := Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	if codec == nil {
+		return nopCloser{w}, nil
+	}
+	if _, ok := codec.(NativeCodec); ok {
+		return codec.NewWriter(w)
+	}
+	if _, err := io.WriteString(w, Magic+string([]byte{byte(len(name))})+name); err != nil {
+		return nil, err
+	}
+	return codec.NewWriter(w)
+}
+
+/**
+Returns a reader decompressing r with the codec named in its header or detected by its magic,
+r as is without either.
+*/
+func NewReader(r io.Reader) (io.ReadCloser, error) {
+	buffered := bufio.NewReader(r)
+	magic, _ := buffered.Peek(len(Magic) + 1)
+	if len(magic) <= len(Magic) || string(magic[:len(Magic)]) != Magic {
+		if codec := detect(buffered); codec != nil {
+			return codec.NewReader(buffered)
+		}
+		return ioutil.NopCloser(buffered), nil
+	}
+	header := make([]byte, len(Magic)+1+int(magic[len(Magic)]))
+	if _, err := io.ReadFull(buffered, header); err != nil {
+		return nil, fmt.Errorf("truncated codec header, err: %w", err)
+	}
+	name := string(header[len(Magic)+1:])
+	codec, err := Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	if codec == nil {
+		return nil, fmt.Errorf("invalid codec in the header: %q", name)
+	}
+	return codec.NewReader(buffered)
+}
+
+/**
+Returns the native codec whose magic starts r, nil if none does.
+*/
+func detect(r *bufio.Reader) Codec {
+	mx.RLock()
+	defer mx.RUnlock()
+	for _, codec := range codecs {
+		native, ok := codec.(NativeCodec)
+		if !ok {
+			continue
+		}
+		magic := native.Magic()
+		if prefix, _ := r.Peek(len(magic)); len(magic) > 0 && bytes.Equal(prefix, magic) {
+			return codec
+		}
+	}
+	return nil
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+/**
+"gzip": compress/gzip at the default level, a native codec readable with zcat.
+*/
+type gzipCodec struct{}
+
+func (gzipCodec) Magic() []byte {
+	return []byte{0x1f, 0x8b}
+}
+
+func (gzipCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriter(w), nil
+}
+
+func (gzipCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+/**
+"flate": raw compress/flate at the fastest level, cheaper than gzip for short lived
+intermediate files.
+*/
+type flateCodec struct{}
+
+func (flateCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return flate.NewWriter(w, flate.BestSpeed)
+}
+
+func (flateCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return flate.NewReader(r), nil
+}
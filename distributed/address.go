@@ -0,0 +1,60 @@
+package distributed
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+/**
+Address handling shared by the Controller and the Workers.
+
+An address is either a TCP address ("host:port", ":port") or a Unix domain socket
+written as "unix:/path/to/socket". The bare value "unix" selects the default socket path.
+*/
+
+const (
+	DefaultControllerAddr = ":1234"
+	DefaultWorkerDialAddr = "127.0.0.1:1234"
+
+	// environment variable used when the --addr flag is not given
+	ControllerAddrEnv = "GOMR_CONTROLLER_ADDR"
+)
+
+const unixAddrPrefix = "unix:"
+
+/**
+Default Unix domain socket path, unique for the current user.
+*/
+func controllerSock() string {
+	s := "/var/tmp/gomr-"
+	s += strconv.Itoa(os.Getuid())
+	return s
+}
+
+/**
+Splits the address into the network and the address understood by net.Listen / rpc.DialHTTP.
+*/
+func parseAddr(addr string) (string, string) {
+	if addr == "unix" {
+		return "unix", controllerSock()
+	}
+	if strings.HasPrefix(addr, unixAddrPrefix) {
+		return "unix", strings.TrimPrefix(addr, unixAddrPrefix)
+	}
+	return "tcp", addr
+}
+
+/**
+Returns the address to use: the flag value if set, otherwise the environment variable,
+otherwise the given default.
+*/
+func ResolveAddr(flagValue string, defaultAddr string) string {
+	if flagValue != "" {
+		return flagValue
+	}
+	if env := os.Getenv(ControllerAddrEnv); env != "" {
+		return env
+	}
+	return defaultAddr
+}
@@ -0,0 +1,77 @@
+package distributed
+
+import (
+	"log"
+	"time"
+)
+
+/**
+Interval at which JobClient.Wait polls the status of a job.
+*/
+const jobStatusInterval = 1 * time.Second
+
+/**
+Client of the jobs API of a running controller, submits jobs and follows their progress.
+*/
+type JobClient struct {
+	client *rpcClient
+}
+
+/**
+Creates a client of the controller at addr, see parseAddr. An unreachable controller is retried
+for deadline.
+*/
+func NewJobClient(addr string, deadline time.Duration) *JobClient {
+	return &JobClient{client: newRPCClient(addr, deadline)}
+}
+
+/**
+Submits a job processing the inputs and returns its id. The inputs are resolved on the controller,
+relative paths are relative to its working directory. A job without an input format gets the
+InputFormat of its plugin.
+*/
+func (c *JobClient) Submit(inputs []string, config JobConfig) (string, error) {
+	if err := resolveInputFormat(&config); err != nil {
+		return "", err
+	}
+	request := SubmitJobRequest{Inputs: inputs, Job: config}
+	response := SubmitJobResponse{}
+	if err := c.client.call("Controller.SubmitJob", &request, &response); err != nil {
+		return "", err
+	}
+	return response.JobId, nil
+}
+
+/**
+Returns the progress of the job.
+*/
+func (c *JobClient) Status(jobId string) (JobStatusResponse, error) {
+	request := JobStatusRequest{JobId: jobId}
+	response := JobStatusResponse{}
+	err := c.client.call("Controller.JobStatus", &request, &response)
+	return response, err
+}
+
+/**
+Blocks until the job completed or failed and returns its final status.
+*/
+func (c *JobClient) Wait(jobId string) (JobStatusResponse, error) {
+	last := JobStatusResponse{}
+	for {
+		status, err := c.Status(jobId)
+		if err != nil {
+			return status, err
+		}
+		if status.State != JobRunning {
+			return status, nil
+		}
+		if status.MapCompleted != last.MapCompleted || status.ReduceCompleted != last.ReduceCompleted {
+			log.Printf(
+				"Job %s: %d of %d map and %d of %d reduce tasks completed", jobId, status.MapCompleted,
+				status.NumMap, status.ReduceCompleted, status.NumReduce,
+			)
+		}
+		last = status
+		time.Sleep(jobStatusInterval)
+	}
+}
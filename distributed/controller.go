@@ -1,18 +1,16 @@
 package distributed
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
-	"gomr.com/gomr/mr"
+	"gomr.com/gomr/input"
 	"log"
 	"net"
 	"net/http"
 	"net/rpc"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"sort"
-	"strconv"
 	"sync"
 	"time"
 )
@@ -25,197 +23,238 @@ const (
 	Completed  State = "completed"
 )
 
-const reduceDirPath = "/tmp/gomr/reduce"
-
 type task struct {
-	state     State
-	startTime time.Time
-	mx        sync.Mutex
-	filename  string
-}
-
-func (t *task) timeout() bool {
-	if time.Since(t.startTime) >= 30*time.Second {
-		return true
-	}
-	return false
+	state    State
+	attempt  int            //number of the latest attempt, every assignment starts a new one
+	accepted int            //attempt whose output was accepted once the task is completed
+	attempts []*taskAttempt //history of the attempts, a straggler can have a backup attempt running
+	skipped  bool           //completed without output after too many failed attempts
+	location string         //shuffle server of the worker of the accepted attempt, it serves the output
+	commit   int            //attempt of a reduce task allowed to publish its output while it runs
+	mx       sync.Mutex
+	split    input.Split //input of a map task
 }
 
-func (t *task) assignTask() {
+/**
+Starts a new attempt of the task on the worker and returns its number.
+*/
+func (t *task) assignTask(workerId string) int {
 	t.state = Assigned
-	t.startTime = time.Now()
+	t.attempt++
+	now := time.Now()
+	t.attempts = append(t.attempts, &taskAttempt{
+		number:    t.attempt,
+		workerId:  workerId,
+		start:     now,
+		renewTime: now,
+		status:    attemptRunning,
+	})
+	return t.attempt
 }
 
 /**
-Represents structure for Controller Node.
+Returns the attempts which are still running.
 */
-type Controller struct {
-	uuid                 string
-	taskTimeout          time.Duration
-	numReduce            int //number of reduce tasks
-	numMap               int //number of map tasks
-	mapTasks             map[int]*task
-	reduceTasks          map[int]*task
-	mapTasksCompleted    bool
-	reduceTasksCompleted bool
+func (t *task) running() []*taskAttempt {
+	running := []*taskAttempt{}
+	for _, a := range t.attempts {
+		if a.status == attemptRunning {
+			running = append(running, a)
+		}
+	}
+	return running
 }
 
 /**
-Helper functions
+Returns the attempt if it is still running, nil otherwise.
 */
+func (t *task) runningAttempt(attempt int) *taskAttempt {
+	for _, a := range t.running() {
+		if a.number == attempt {
+			return a
+		}
+	}
+	return nil
+}
 
 /**
-Combines all the reduce mr-numMap-numReduce files into mr-reduce-numReduce.
-
-Basically combines all the inputs for a particular reduce partition from all the map
-operation into a single reduce file.
+Returns the attempt whose output was accepted, nil unless the task completed with output.
 */
-func (c *Controller) sortIntermediate() {
-	log.Printf("Starts Combining Reduce partition in all map operations")
-	log.Printf("The reduce files output %s", reduceDirPath)
-	//remove everything from temp directory
-	os.RemoveAll(reduceDirPath)
-	err := os.Mkdir(reduceDirPath, os.ModePerm)
-
-	if err != nil {
-		log.Printf("Failed to create temp directory: %v for processing, err: %v", reduceDirPath, err)
+func (t *task) acceptedAttempt() *taskAttempt {
+	if t.state != Completed || t.skipped {
+		return nil
 	}
-
-	for i := 0; i < c.numReduce; i++ {
-
-		if err != nil {
-			log.Printf("Failed to create temp directory: %v for processing, err: %v", reduceDirPath, err)
+	for _, a := range t.attempts {
+		if a.number == t.accepted {
+			return a
 		}
+	}
+	return nil
+}
 
-		reduceFileName := fmt.Sprintf("mr-reduce-%d", i)
-		reduceFile, err := os.OpenFile(
-			filepath.Join(reduceDirPath, reduceFileName), os.O_RDWR|os.O_CREATE|os.O_EXCL, os.ModePerm,
-		)
-		if err != nil {
-			log.Fatalf(
-				"Failed to create output file for dir: %v and filename %v, err: %v", reduceDirPath,
-				reduceFileName, err,
-			)
+/**
+Ends the running attempts whose lease expired, i.e. whose worker did not send a heartbeat
+for timeout, and returns them.
+*/
+func (t *task) expire(timeout time.Duration) []*taskAttempt {
+	expired := []*taskAttempt{}
+	for _, a := range t.running() {
+		if time.Since(a.renewTime) >= timeout {
+			a.finish(attemptTimedOut, fmt.Sprintf("no heartbeat for %v", timeout))
+			expired = append(expired, a)
 		}
+	}
+	return expired
+}
 
-		encoder := json.NewEncoder(reduceFile)
-		keyValueArr := []mr.KeyValue{}
-		for j := 0; j < c.numMap; j++ {
-			mapPartitionFileName := fmt.Sprintf("mr-%d-%d", j, i)
-			mapPartitionFile, err := os.Open(filepath.Join(mapOutputDirName, mapPartitionFileName))
-			if err != nil {
-				log.Printf("Warn: Unable to open the mapPartition File %v, err: %v", mapPartitionFileName, err)
-			}
-			decoder := json.NewDecoder(mapPartitionFile)
-
-			for {
-				var kv mr.KeyValue
-				if err := decoder.Decode(&kv); err != nil {
-					break
-				}
-				keyValueArr = append(keyValueArr, kv)
-			}
-			mapPartitionFile.Close()
-		}
-		sort.Sort(mr.SortKey(keyValueArr))
+/**
+Checks if the task completed with the output of the attempt, e.g. when a worker retries the
+report of its completion because the reply got lost.
+*/
+func (t *task) completedBy(attempt int) bool {
+	return t.state == Completed && !t.skipped && t.accepted == attempt
+}
 
-		for _, kv := range keyValueArr {
-			encoder.Encode(&kv)
-		}
-		c.reduceTasks[i].filename = reduceFileName
-		reduceFile.Close()
+/**
+Checks if the completion of the attempt can be accepted and returns it: only a running attempt
+of a task which is not completed yet is, the output of a stale attempt whose lease expired is
+rejected.
+*/
+func (t *task) acceptAttempt(taskId int, attempt int) *taskAttempt {
+	if t.state == Completed {
+		log.Printf("The task: %d already completed by attempt %d", taskId, t.accepted)
+		return nil
+	}
+	a := t.runningAttempt(attempt)
+	if a == nil {
+		log.Printf("Rejecting the stale attempt %d of task: %d, latest attempt: %d", attempt, taskId, t.attempt)
 	}
+	return a
 }
 
-/*
-Check for all the Map tasks completion.
+/**
+Checks if the attempt of a reduce task may publish its output: only one running attempt at a
+time is allowed to, until it completed or stopped running.
 */
-func (c *Controller) isMapTaskCompleted() bool {
-	if c.mapTasksCompleted == true {
-		return true
+func (t *task) allowCommit(taskId int, attempt int) bool {
+	if t.state == Completed {
+		return t.accepted == attempt
 	}
-	for _, t := range c.mapTasks {
-		t.mx.Lock()
-		if t.state != Completed {
-			t.mx.Unlock()
-			return false
-		}
-		t.mx.Unlock()
+	if t.runningAttempt(attempt) == nil {
+		log.Printf("Rejecting the commit of the stale attempt %d of task: %d, latest attempt: %d", attempt, taskId, t.attempt)
+		return false
+	}
+	if t.commit != attempt && t.runningAttempt(t.commit) != nil {
+		log.Printf("Rejecting the commit of the attempt %d of task: %d, attempt %d commits", attempt, taskId, t.commit)
+		return false
 	}
-	c.mapTasksCompleted = true
-	c.sortIntermediate()
+	t.commit = attempt
 	return true
 }
 
-func (c *Controller) assignMapTask() int {
-	taskId := -1
-	for i, t := range c.mapTasks {
-		t.mx.Lock()
-		if t.state == Completed || (t.state == Assigned && !t.timeout()) {
-			t.mx.Unlock()
-			continue
-		}
-		if t.timeout() {
-			log.Printf("Assigning timed out task %d \n", i)
+/**
+Extends the leases of the running attempts of the worker.
+*/
+func (t *task) renew(workerId string) {
+	for _, a := range t.running() {
+		if a.workerId == workerId {
+			a.renewTime = time.Now()
 		}
-		t.assignTask()
-		taskId = i
-		log.Printf("Assigning Task %d to the worker", i)
-		t.mx.Unlock()
-		break
 	}
-	if taskId == -1 {
-		log.Printf("Not available free Map Task Found")
-	}
-	return taskId
 }
 
-/*
-Check for all the Map tasks completion.
+/**
+Represents structure for Controller Node. The controller runs the jobs submitted to it side by
+side, their tasks are handed out to the shared workers first come first served.
 */
-func (c *Controller) isReduceTaskCompleted() bool {
-	if c.reduceTasksCompleted == true {
-		return true
+type Controller struct {
+	mx      sync.Mutex
+	jobs    map[string]*job
+	jobIds  []string        //in submission order
+	workers *workerRegistry //shared by the jobs
+	serve   bool            //keep running once the jobs ended, to accept further submissions
+}
+
+/**
+Returns the job with the id.
+*/
+func (c *Controller) job(jobId string) (*job, error) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	j, ok := c.jobs[jobId]
+	if !ok {
+		return nil, fmt.Errorf("unknown job %q", jobId)
 	}
-	for _, t := range c.reduceTasks {
-		t.mx.Lock()
-		if t.state != Completed {
-			t.mx.Unlock()
-			return false
-		}
-		t.mx.Unlock()
+	return j, nil
+}
+
+/**
+Returns the jobs in submission order.
+*/
+func (c *Controller) jobList() []*job {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	jobs := []*job{}
+	for _, jobId := range c.jobIds {
+		jobs = append(jobs, c.jobs[jobId])
 	}
-	c.reduceTasksCompleted = true
-	return true
+	return jobs
 }
 
-func (c *Controller) assignReduceTask() int {
-	taskId := -1
-	for i, t := range c.reduceTasks {
-		t.mx.Lock()
-		if t.state == Completed || (t.state == Assigned && !t.timeout()) {
-			t.mx.Unlock()
-			continue
-		}
-		if t.timeout() {
-			log.Printf("Assigning timed out task %d \n", i)
-		}
-		t.assignTask()
-		taskId = i
-		log.Printf("Assigning Task %d to the worker", i)
-		t.mx.Unlock()
-		break
+/**
+Returns the job of the request, or all the jobs if jobId is empty.
+*/
+func (c *Controller) selectJobs(jobId string) ([]*job, error) {
+	if jobId == "" {
+		return c.jobList(), nil
 	}
-	if taskId == -1 {
-		log.Printf("Not available free Reduce Task Found")
+	j, err := c.job(jobId)
+	if err != nil {
+		return nil, err
 	}
-	return taskId
+	return []*job{j}, nil
+}
+
+func (c *Controller) addJob(j *job) error {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if _, ok := c.jobs[j.id]; ok {
+		return fmt.Errorf("the job %s is already running", j.id)
+	}
+	c.jobs[j.id] = j
+	c.jobIds = append(c.jobIds, j.id)
+	return nil
 }
 
 /**
 APIS
 */
 
+/**
+Jobs
+*/
+
+func (c *Controller) SubmitJob(request *SubmitJobRequest, response *SubmitJobResponse) error {
+	log.Printf("Handling the submission of a job with %d reduce tasks for %v", request.Job.NumReduce, request.Inputs)
+	//the submitter resolved the input format, the plugin is not opened for it here
+	jobId, err := c.submit(request.Inputs, request.Job)
+	if err != nil {
+		log.Printf("Rejected the job, err: %v", err)
+		return err
+	}
+	response.JobId = jobId
+	return nil
+}
+
+func (c *Controller) JobStatus(request *JobStatusRequest, response *JobStatusResponse) error {
+	j, err := c.job(request.JobId)
+	if err != nil {
+		return err
+	}
+	*response = j.status()
+	return nil
+}
+
 /**
 Map
 */
@@ -224,7 +263,16 @@ func (c *Controller) CheckForMapTasksCompletion(
 	request *CheckForMapTasksCompletionRequest, response *CheckForMapTasksCompletionResponse,
 ) error {
 	log.Println("CheckForMapTasksCompletion Called")
-	response.AllCompleted = c.isMapTaskCompleted()
+	jobs, err := c.selectJobs(request.JobId)
+	if err != nil {
+		return err
+	}
+	response.AllCompleted = true
+	for _, j := range jobs {
+		if !j.isMapTaskCompleted() {
+			response.AllCompleted = false
+		}
+	}
 	return nil
 }
 
@@ -233,16 +281,39 @@ func (c *Controller) GetMapTask(
 	response *GetMapTaskResponse,
 ) error {
 	log.Println("GetMapTask Called")
-	if c.mapTasksCompleted {
-		response.TaskId = -1
-		return nil
+	if c.Done() {
+		return errors.New(errJobDoneMessage)
 	}
-	taskId := c.assignMapTask()
-	response.TaskId = taskId
-	response.NumReduce = c.numReduce
-	if taskId != -1 {
-		response.Filename = c.mapTasks[taskId].filename
+	if !c.workers.known(request.WorkerId) {
+		return errors.New(errUnknownWorkerMessage)
 	}
+	response.TaskId = -1
+	for _, j := range c.jobList() {
+		if j.done() || j.isMapTaskCompleted() || c.workers.refused(request.WorkerId, j.id) {
+			continue
+		}
+		taskId, attempt := j.assignMapTask(request.WorkerId)
+		if taskId == -1 {
+			continue
+		}
+		split := j.mapTasks[taskId].split
+		response.JobId = j.id
+		response.PluginHash = j.pluginHash
+		response.TaskId = taskId
+		response.Attempt = attempt
+		response.NumReduce = j.numReduce
+		response.Filename = split.Filename
+		response.Offset = split.Offset
+		response.Length = split.Length
+		response.InputFormat = j.inputFormat
+		response.NoSort = j.noSort
+		response.IntermediateFormat = j.intermediate.name
+		response.IntermediateCodec = j.intermediate.codec
+		response.Partitioner = j.partitioner
+		response.RangeBoundaries = j.rangeBoundaries
+		return nil
+	}
+	log.Printf("Not available free Map Task Found")
 	return nil
 }
 
@@ -251,16 +322,34 @@ func (c *Controller) UpdateMapTask(
 	response *UpdateMapTaskResponse,
 ) error {
 
-	log.Printf("Handling request for the completion of MapTask: %d", request.TaskId)
-	task := c.mapTasks[request.TaskId]
+	log.Printf(
+		"Handling request for the completion of MapTask: %d attempt %d of job %s by %s", request.TaskId,
+		request.Attempt, request.JobId, request.WorkerId,
+	)
+	j, err := c.job(request.JobId)
+	if err != nil {
+		return err
+	}
+	task, ok := j.mapTasks[request.TaskId]
+	if !ok {
+		return fmt.Errorf("unknown map task %d of job %s", request.TaskId, request.JobId)
+	}
 	task.mx.Lock()
 	defer task.mx.Unlock()
 
-	if task.state == Completed {
-		log.Printf("The task: %d already completed by other worker", request.TaskId)
+	if task.completedBy(request.Attempt) {
+		log.Printf("The task: %d already completed by attempt %d, accepting the report again", request.TaskId, request.Attempt)
+		response.Accepted = true
+		return nil
+	}
+	attempt := task.acceptAttempt(request.TaskId, request.Attempt)
+	if attempt == nil {
+		response.Accepted = false
 		return nil
 	}
-	task.state = Completed
+	task.location = request.ShuffleAddr
+	j.completeTask(MapPhase, request.TaskId, task, attempt)
+	response.Accepted = true
 	log.Printf("Handled UpdateMap Task as completed for taskId: %d", request.TaskId)
 	return nil
 }
@@ -272,7 +361,16 @@ func (c *Controller) CheckForReduceTasksCompletion(
 	request *CheckForReduceTasksCompletionRequest, response *CheckForReducdTasksCompletionResponse,
 ) error {
 	log.Println("CheckForReduceTasksCompletion Called")
-	response.AllCompleted = c.isReduceTaskCompleted()
+	jobs, err := c.selectJobs(request.JobId)
+	if err != nil {
+		return err
+	}
+	response.AllCompleted = true
+	for _, j := range jobs {
+		if !j.isReduceTaskCompleted() {
+			response.AllCompleted = false
+		}
+	}
 	return nil
 }
 
@@ -281,15 +379,59 @@ func (c *Controller) GetReduceTask(
 	response *GetReduceTaskResponse,
 ) error {
 	log.Println("GetReduceTask Called")
-	if c.reduceTasksCompleted {
-		response.TaskId = -1
+	if c.Done() {
+		return errors.New(errJobDoneMessage)
+	}
+	if !c.workers.known(request.WorkerId) {
+		return errors.New(errUnknownWorkerMessage)
+	}
+	response.TaskId = -1
+	for _, j := range c.jobList() {
+		//the reduce tasks of a job start once all of its map tasks completed
+		if j.done() || !j.isMapTaskCompleted() || c.workers.refused(request.WorkerId, j.id) {
+			continue
+		}
+		taskId, attempt := j.assignReduceTask(request.WorkerId)
+		if taskId == -1 {
+			continue
+		}
+		response.JobId = j.id
+		response.PluginHash = j.pluginHash
+		response.TaskId = taskId
+		response.Attempt = attempt
+		response.NumMap = j.numMap
+		response.MapAttempts, response.MapLocations = j.acceptedMapOutputs()
+		response.OutputFormat = j.outputFormat
+		response.OutputCodec = j.outputCodec
+		response.NoSort = j.noSort
+		response.IntermediateFormat = j.intermediate.name
+		response.IntermediateCodec = j.intermediate.codec
 		return nil
 	}
-	taskId := c.assignReduceTask()
-	response.TaskId = taskId
-	if taskId != -1 {
-		response.Filename = c.reduceTasks[taskId].filename
+	log.Printf("Not available free Reduce Task Found")
+	return nil
+}
+
+/**
+Asked by a reduce attempt which wrote its output before it publishes it under the final name.
+The attempt reports its completion with UpdateReduceTask once it published the output, the
+task is not completed before, so an attempt which fails or stops meanwhile is run again.
+*/
+func (c *Controller) CanCommitReduceTask(
+	request *CanCommitReduceTaskRequest,
+	response *CanCommitReduceTaskResponse,
+) error {
+	j, err := c.job(request.JobId)
+	if err != nil {
+		return err
+	}
+	task, ok := j.reduceTasks[request.TaskId]
+	if !ok {
+		return fmt.Errorf("unknown reduce task %d of job %s", request.TaskId, request.JobId)
 	}
+	task.mx.Lock()
+	defer task.mx.Unlock()
+	response.Allowed = task.allowCommit(request.TaskId, request.Attempt)
 	return nil
 }
 
@@ -297,80 +439,299 @@ func (c *Controller) UpdateReduceTask(
 	request *UpdateReduceTaskRequest,
 	response *UpdateReduceTaskResponse,
 ) error {
-	log.Printf("Handling request for the completion of ReduceTask: %d", request.TaskId)
-	task := c.reduceTasks[request.TaskId]
+	log.Printf(
+		"Handling request for the completion of ReduceTask: %d attempt %d of job %s by %s", request.TaskId,
+		request.Attempt, request.JobId, request.WorkerId,
+	)
+	j, err := c.job(request.JobId)
+	if err != nil {
+		return err
+	}
+	task, ok := j.reduceTasks[request.TaskId]
+	if !ok {
+		return fmt.Errorf("unknown reduce task %d of job %s", request.TaskId, request.JobId)
+	}
 	task.mx.Lock()
 	defer task.mx.Unlock()
 
-	if task.state == Completed {
-		log.Printf("The task: %d already completed by other worker", request.TaskId)
+	if task.completedBy(request.Attempt) {
+		log.Printf("The task: %d already completed by attempt %d, accepting the report again", request.TaskId, request.Attempt)
+		response.Accepted = true
+		return nil
+	}
+	attempt := task.acceptAttempt(request.TaskId, request.Attempt)
+	if attempt == nil {
+		response.Accepted = false
 		return nil
 	}
-	task.state = Completed
+	task.location = request.ShuffleAddr
+	j.completeTask(ReducePhase, request.TaskId, task, attempt)
+	response.Accepted = true
 	log.Printf("Handled UpdateReduceTask as completed for taskId: %d", request.TaskId)
 	return nil
 
 }
 
 /**
-Starts the Controller given the list of files and the number of reduce tasks to use.
+Workers
+*/
+
+func (c *Controller) RegisterWorker(request *RegisterWorkerRequest, response *RegisterWorkerResponse) error {
+	workerId, number := c.workers.register(request.Host, request.Pid, request.Capacity)
+	//every running job can be resumed on its own, each of them keeps the worker numbers handed out
+	for _, j := range c.jobList() {
+		if !j.done() {
+			j.journal.append(journalRecord{Worker: number})
+		}
+	}
+	response.WorkerId = workerId
+	return nil
+}
+
+/**
+Removes a worker which is shutting down. The tasks still assigned to it are handed out
+again right away instead of after their lease expired.
+*/
+func (c *Controller) DeregisterWorker(request *DeregisterWorkerRequest, response *DeregisterWorkerResponse) error {
+	c.removeWorker(request.WorkerId, "worker stopped")
+	return nil
+}
+
+/**
+Removes the worker: its running attempts are released and the map outputs its shuffle server
+served are lost, their map tasks run again for the jobs with reduce tasks left.
+*/
+func (c *Controller) removeWorker(workerId string, reason string) {
+	mapTasks, reduceTasks, ok := c.workers.deregister(workerId)
+	if !ok {
+		return
+	}
+	release := func(phase string, refs []TaskRef) {
+		for _, ref := range refs {
+			if j, err := c.job(ref.JobId); err == nil {
+				j.release(phase, ref.TaskId, workerId, reason)
+			}
+		}
+	}
+	release(MapPhase, mapTasks)
+	release(ReducePhase, reduceTasks)
+	for _, j := range c.jobList() {
+		j.loseMapOutputs(workerId)
+	}
+}
+
+/**
+Removes the workers which did not send a heartbeat for timeout, e.g. because their host went
+down, checked every heartbeat interval.
 */
+func (c *Controller) watchWorkers(timeout time.Duration) {
+	for range time.Tick(heartbeatInterval) {
+		for _, workerId := range c.workers.lapsed(timeout) {
+			log.Printf("No heartbeat from %s for %v, removing it", workerId, timeout)
+			c.removeWorker(workerId, fmt.Sprintf("no heartbeat from the worker for %v", timeout))
+		}
+	}
+}
 
-func masterSock() string {
-	s := "/var/tmp/824-mr-"
-	s += strconv.Itoa(os.Getuid())
-	return s
+/**
+Heartbeat
+*/
+
+func (c *Controller) Heartbeat(request *HeartbeatRequest, response *HeartbeatResponse) error {
+	if !c.workers.heartbeat(request.WorkerId) {
+		return errors.New(errUnknownWorkerMessage)
+	}
+	renew := func(phase string, refs []TaskRef) {
+		for _, ref := range refs {
+			if j, err := c.job(ref.JobId); err == nil {
+				j.renew(phase, ref.TaskId, request.WorkerId)
+			}
+		}
+	}
+	renew(MapPhase, request.MapTasks)
+	renew(ReducePhase, request.ReduceTasks)
+	response.EndedJobs = c.workers.endedJobs(request.WorkerId, func(jobId string) bool {
+		j, err := c.job(jobId)
+		return err == nil && j.done()
+	})
+	return nil
 }
 
-func (c *Controller) server() {
+/**
+Starts the Controller given the list of files and the number of reduce tasks to use.
+*/
+
+func (c *Controller) server(addr string) {
 	rpc.Register(c)
 	rpc.HandleHTTP()
-	l, e := net.Listen("tcp", ":1234")
+	network, address := parseAddr(addr)
+	if network == "unix" {
+		//remove the stale socket left by an earlier controller
+		os.Remove(address)
+	}
+	l, e := net.Listen(network, address)
 	if e != nil {
 		log.Fatal("listen error:", e)
 	}
+	log.Printf("Controller listening on %s %s", network, address)
 	go http.Serve(l, nil)
 
 }
 
+/**
+Checks if the controller can stop: all of its jobs ended and it does not serve further submissions.
+*/
 func (c *Controller) Done() bool {
-	if c.mapTasksCompleted && c.reduceTasksCompleted {
-		return true
+	if c.serve {
+		return false
+	}
+	for _, j := range c.jobList() {
+		if !j.done() {
+			return false
+		}
 	}
-	return false
+	return true
 }
 
-func MakerController(files []string, nReduce int) *Controller {
+/**
+Configuration of a Controller.
+*/
+type ControllerConfig struct {
+	Addr          string        //address to listen on, see parseAddr
+	Serve         bool          //keep running and accept further jobs once the submitted ones ended
+	WorkerTimeout time.Duration //a worker is removed after it sent no heartbeat for this long
+}
+
+func MakerController(config ControllerConfig) *Controller {
 	c := Controller{}
-	uuid, err := exec.Command("uuidgen").Output()
+	c.jobs = make(map[string]*job)
+	c.workers = newWorkerRegistry()
+	c.serve = config.Serve
+	c.server(config.Addr)
+	if config.WorkerTimeout <= 0 {
+		config.WorkerTimeout = DefaultWorkerTimeout
+	}
+	go c.watchWorkers(config.WorkerTimeout)
+	return &c
+}
+
+/**
+Submits a job processing the files and returns its id. Its tasks are handed out to the workers
+once the tasks of the jobs submitted earlier are. A job without an input format gets the
+InputFormat of its plugin.
+*/
+func (c *Controller) Submit(files []string, config JobConfig) (string, error) {
+	if err := resolveInputFormat(&config); err != nil {
+		return "", err
+	}
+	return c.submit(files, config)
+}
+
+func (c *Controller) submit(files []string, config JobConfig) (string, error) {
+	j, err := newJob(files, config, c.workers)
 	if err != nil {
-		log.Fatal("Unable to generate UUID: %s", err)
-	}
-
-	c.uuid = string(uuid)
-	c.taskTimeout = 10 * time.Second
-	c.numMap = len(files)
-	c.numReduce = nReduce
-	c.mapTasks = make(map[int]*task)
-	c.reduceTasks = make(map[int]*task)
-	c.mapTasksCompleted = false
-	c.reduceTasksCompleted = false
-
-	for i := 0; i < c.numMap; i++ {
-		c.mapTasks[i] = &task{
-			filename:  files[i],
-			state:     Unassigned,
-			startTime: time.Now(),
-		}
+		return "", err
 	}
+	if number := c.workers.lastNumber(); number > 0 {
+		j.journal.append(journalRecord{Worker: number})
+	}
+	if err := c.addJob(j); err != nil {
+		return "", err
+	}
+	return j.id, nil
+}
 
-	for i := 0; i < c.numReduce; i++ {
-		c.reduceTasks[i] = &task{
-			state:     Unassigned,
-			startTime: time.Now(),
-			filename:  "",
+/**
+Resumes the job journaled in dir, e.g. after the controller crashed, and returns its id.
+*/
+func (c *Controller) Resume(dir string) (string, error) {
+	j, err := resumeJob(dir, c.workers)
+	if err != nil {
+		return "", err
+	}
+	if err := c.addJob(j); err != nil {
+		j.journal.file.Close()
+		return "", err
+	}
+	return j.id, nil
+}
+
+/**
+Resumes the jobs journaled in the job directories which did not end yet, e.g. all the jobs of
+a crashed controller which accepted several, and returns their ids. The jobs are resumed in
+their submission order, a job which cannot be resumed is logged and skipped.
+*/
+func (c *Controller) ResumeAll() ([]string, error) {
+	journals, err := filepath.Glob(filepath.Join(jobsDirName, "*", journalFileName))
+	if err != nil {
+		return nil, err
+	}
+	jobs := []*job{}
+	for _, path := range journals {
+		j, err := resumeJob(filepath.Dir(path), c.workers)
+		if err != nil {
+			log.Printf("Unable to resume the job in %v, err: %v", filepath.Dir(path), err)
+			continue
 		}
+		if j.done() {
+			j.journal.file.Close()
+			continue
+		}
+		jobs = append(jobs, j)
 	}
-	c.server()
-	return &c
+	sort.SliceStable(jobs, func(i, k int) bool { return jobs[i].submitted.Before(jobs[k].submitted) })
+	jobIds := []string{}
+	for _, j := range jobs {
+		if err := c.addJob(j); err != nil {
+			j.journal.file.Close()
+			return jobIds, err
+		}
+		jobIds = append(jobIds, j.id)
+	}
+	return jobIds, nil
+}
+
+/**
+Returns the ids of the jobs in submission order.
+*/
+func (c *Controller) JobIds() []string {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	return append([]string{}, c.jobIds...)
+}
+
+/**
+Returns why the job failed, nil unless a task failed too many attempts under the FailJob policy.
+*/
+func (c *Controller) JobErr(jobId string) error {
+	j, err := c.job(jobId)
+	if err != nil {
+		return err
+	}
+	return j.failure()
+}
+
+/**
+Summarizes the tasks of the job which had failed attempts, see job.failureSummary.
+*/
+func (c *Controller) FailureSummary(jobId string) string {
+	j, err := c.job(jobId)
+	if err != nil {
+		return ""
+	}
+	return j.failureSummary()
+}
+
+/**
+Returns the directory of the job holding its journal and its output, see Resume.
+*/
+func JobDir(jobId string) string {
+	return jobDir(jobId)
+}
+
+/**
+Returns the directory the reduce tasks of the job write their output to.
+*/
+func JobOutputDir(jobId string) string {
+	return jobOutputDir(jobId)
 }
@@ -0,0 +1,395 @@
+package distributed
+
+import (
+	"fmt"
+	"gomr.com/gomr/input"
+	"gomr.com/gomr/output"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestController() *Controller {
+	return &Controller{jobs: make(map[string]*job), workers: newWorkerRegistry()}
+}
+
+/**
+Returns the spec of a job with numMap map and numReduce reduce tasks which fails after
+maxAttempts failed attempts of a task, without speculation.
+*/
+func testJobSpec(numMap int, numReduce int, maxAttempts int) journalJob {
+	spec := journalJob{
+		Uuid:          fmt.Sprintf("test-%d", time.Now().UnixNano()),
+		NumReduce:     numReduce,
+		MaxAttempts:   maxAttempts,
+		FailurePolicy: FailJob,
+	}
+	for i := 0; i < numMap; i++ {
+		spec.Splits = append(spec.Splits, input.Split{Filename: fmt.Sprintf("input-%d", i)})
+	}
+	return spec
+}
+
+/**
+Creates the job of the spec, journaled in a temporary directory, and adds it to the controller.
+*/
+func newTestJob(t *testing.T, c *Controller, spec journalJob) *job {
+	t.Helper()
+	j := makeJob(spec, c.workers)
+	var err error
+	j.journal, err = createJournal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { j.journal.file.Close() })
+	j.journal.append(journalRecord{Job: &spec})
+	if err := c.addJob(j); err != nil {
+		t.Fatal(err)
+	}
+	return j
+}
+
+func quietLog(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+}
+
+func TestHeartbeatWhileAssigningTasks(t *testing.T) {
+	quietLog(t)
+	c := newTestController()
+	j := newTestJob(t, c, testJobSpec(20, 1, 1<<30))
+
+	var heartbeats, assignments sync.WaitGroup
+	stop := make(chan struct{})
+	for w := 0; w < 4; w++ {
+		workerId, _ := c.workers.register("localhost", w, 1)
+		//the heartbeats look for ended jobs while the tasks are assigned and fail
+		heartbeats.Add(1)
+		go func() {
+			defer heartbeats.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if err := c.Heartbeat(&HeartbeatRequest{WorkerId: workerId}, &HeartbeatResponse{}); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+		assignments.Add(1)
+		go func() {
+			defer assignments.Done()
+			for i := 0; i < 500; i++ {
+				response := GetMapTaskResponse{}
+				if err := c.GetMapTask(&GetMapTaskRequest{WorkerId: workerId}, &response); err != nil {
+					t.Error(err)
+					return
+				}
+				if response.TaskId == -1 {
+					continue
+				}
+				request := ReportTaskFailureRequest{
+					WorkerId: workerId, JobId: j.id, Phase: MapPhase, TaskId: response.TaskId,
+					Attempt: response.Attempt, Error: "failed",
+				}
+				if err := c.ReportTaskFailure(&request, &ReportTaskFailureResponse{}); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		assignments.Wait()
+		close(stop)
+		heartbeats.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(time.Minute):
+		t.Fatal("the heartbeats and the task assignments deadlocked")
+	}
+}
+
+func TestRefusedTaskIsHandedToOtherWorkers(t *testing.T) {
+	quietLog(t)
+	c := newTestController()
+	j := newTestJob(t, c, testJobSpec(1, 1, 1))
+	refusing, _ := c.workers.register("localhost", 1, 1)
+	other, _ := c.workers.register("localhost", 2, 1)
+
+	response := GetMapTaskResponse{}
+	if err := c.GetMapTask(&GetMapTaskRequest{WorkerId: refusing}, &response); err != nil || response.TaskId != 0 {
+		t.Fatalf("got task %d, err: %v", response.TaskId, err)
+	}
+	request := ReportTaskFailureRequest{
+		WorkerId: refusing, JobId: j.id, Phase: MapPhase, TaskId: 0, Attempt: response.Attempt,
+		Error: errPluginConflict.Error(), Refused: true,
+	}
+	if err := c.ReportTaskFailure(&request, &ReportTaskFailureResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.failure(); err != nil {
+		t.Fatalf("the refusal failed the job with a single attempt allowed: %v", err)
+	}
+	if failed := j.mapTasks[0].failedAttempts(); failed != 0 {
+		t.Fatalf("the refusal counts as %d failed attempts", failed)
+	}
+
+	response = GetMapTaskResponse{}
+	if err := c.GetMapTask(&GetMapTaskRequest{WorkerId: refusing}, &response); err != nil || response.TaskId != -1 {
+		t.Fatalf("the refusing worker got task %d, err: %v", response.TaskId, err)
+	}
+	if err := c.GetMapTask(&GetMapTaskRequest{WorkerId: other}, &response); err != nil || response.TaskId != 0 {
+		t.Fatalf("the other worker got task %d, err: %v", response.TaskId, err)
+	}
+}
+
+/**
+Reports the completion of the attempt of the task through the controller, returns if it was accepted.
+*/
+func reportCompletion(t *testing.T, c *Controller, j *job, phase string, taskId int, attempt int) bool {
+	t.Helper()
+	var accepted bool
+	var err error
+	if phase == MapPhase {
+		response := UpdateMapTaskResponse{}
+		request := UpdateMapTaskRequest{WorkerId: "worker-1", JobId: j.id, TaskId: taskId, Attempt: attempt, ShuffleAddr: "host:1"}
+		err = c.UpdateMapTask(&request, &response)
+		accepted = response.Accepted
+	} else {
+		response := UpdateReduceTaskResponse{}
+		request := UpdateReduceTaskRequest{WorkerId: "worker-1", JobId: j.id, TaskId: taskId, Attempt: attempt, ShuffleAddr: "host:1"}
+		err = c.UpdateReduceTask(&request, &response)
+		accepted = response.Accepted
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return accepted
+}
+
+func TestStaleAttemptsAreRejected(t *testing.T) {
+	quietLog(t)
+	tests := []struct {
+		name     string
+		setup    func(task *task) //starts the attempts of the task
+		reports  []int            //attempts reporting their completion in order
+		accepted []bool
+		state    State
+		winner   int //accepted attempt of the task
+	}{
+		{
+			"running attempt",
+			func(task *task) { task.assignTask("worker-1") },
+			[]int{1}, []bool{true}, Completed, 1,
+		},
+		{
+			"report sent again",
+			func(task *task) { task.assignTask("worker-1") },
+			[]int{1, 1}, []bool{true, true}, Completed, 1,
+		},
+		{
+			"attempt whose lease expired",
+			func(task *task) {
+				task.assignTask("worker-1")
+				task.expire(0)
+				task.assignTask("worker-2")
+			},
+			[]int{1, 2}, []bool{false, true}, Completed, 2,
+		},
+		{
+			"expired attempt without successor",
+			func(task *task) {
+				task.assignTask("worker-1")
+				task.expire(0)
+				task.state = Unassigned
+			},
+			[]int{1}, []bool{false}, Unassigned, 0,
+		},
+		{
+			"backup attempt completing first",
+			func(task *task) {
+				task.assignTask("worker-1")
+				task.assignTask("worker-2")
+			},
+			[]int{2, 1, 2}, []bool{true, false, true}, Completed, 2,
+		},
+		{
+			"unknown attempt",
+			func(task *task) { task.assignTask("worker-1") },
+			[]int{3}, []bool{false}, Assigned, 0,
+		},
+		{
+			"failed attempt",
+			func(task *task) {
+				task.assignTask("worker-1")
+				task.attempts[0].finish(attemptFailed, "failed")
+				task.assignTask("worker-2")
+			},
+			[]int{1}, []bool{false}, Assigned, 0,
+		},
+	}
+	for _, phase := range []string{MapPhase, ReducePhase} {
+		for _, test := range tests {
+			c := newTestController()
+			j := newTestJob(t, c, testJobSpec(1, 1, 4))
+			task := j.tasks(phase)[0]
+			test.setup(task)
+			for i, attempt := range test.reports {
+				if accepted := reportCompletion(t, c, j, phase, 0, attempt); accepted != test.accepted[i] {
+					t.Errorf("%s %s: report %d of attempt %d accepted %v", phase, test.name, i, attempt, accepted)
+				}
+			}
+			if task.state != test.state || task.accepted != test.winner {
+				t.Errorf("%s %s: the task is %v, accepted attempt %d", phase, test.name, task.state, task.accepted)
+			}
+			for _, a := range task.attempts {
+				if a.number != test.winner && a.status == attemptSucceeded {
+					t.Errorf("%s %s: the rejected attempt %d succeeded", phase, test.name, a.number)
+				}
+			}
+		}
+	}
+}
+
+func TestMaxAttemptsAndFailurePolicy(t *testing.T) {
+	quietLog(t)
+	const (
+		fail    = "fail"    //the worker reports the failure
+		timeout = "timeout" //the lease expires
+		release = "release" //the worker stops, does not count as a failure
+	)
+	tests := []struct {
+		maxAttempts int
+		policy      string
+		outcomes    []string //of the attempts in order
+		next        int      //attempt handed out afterwards, 0 for none
+		failed      bool     //the job failed
+		skipped     bool
+	}{
+		{1, FailJob, []string{fail}, 0, true, false},
+		{3, FailJob, []string{fail, fail}, 3, false, false},
+		{3, FailJob, []string{fail, timeout, fail}, 0, true, false},
+		{2, FailJob, []string{timeout, timeout}, 0, true, false},
+		{2, FailJob, []string{release, release, fail}, 4, false, false},
+		{2, SkipTask, []string{fail}, 2, false, false},
+		{2, SkipTask, []string{fail, timeout}, 0, false, true},
+		{1, SkipTask, []string{release, fail}, 0, false, true},
+	}
+	for _, phase := range []string{MapPhase, ReducePhase} {
+		for _, test := range tests {
+			c := newTestController()
+			spec := testJobSpec(1, 1, test.maxAttempts)
+			spec.FailurePolicy = test.policy
+			j := newTestJob(t, c, spec)
+			task := j.tasks(phase)[0]
+			for i, outcome := range test.outcomes {
+				taskId, attempt := j.assignTask(phase, "worker-1")
+				if taskId != 0 || attempt != i+1 {
+					t.Fatalf("%s %v: got task %d attempt %d, expected attempt %d", phase, test, taskId, attempt, i+1)
+				}
+				switch outcome {
+				case fail:
+					request := ReportTaskFailureRequest{
+						WorkerId: "worker-1", JobId: j.id, Phase: phase, TaskId: 0, Attempt: attempt, Error: "failed",
+					}
+					if err := c.ReportTaskFailure(&request, &ReportTaskFailureResponse{}); err != nil {
+						t.Fatal(err)
+					}
+				case timeout:
+					//expired by the next assignment
+					task.attempts[i].renewTime = time.Now().Add(-2 * j.timeout(phase).lease())
+				case release:
+					j.release(phase, 0, "worker-1", "stopped")
+				}
+			}
+
+			taskId, attempt := j.assignTask(phase, "worker-1")
+			if test.next == 0 && taskId != -1 || test.next != 0 && attempt != test.next {
+				t.Errorf("%s %v: got task %d attempt %d afterwards", phase, test, taskId, attempt)
+			}
+			if failed := j.failure() != nil; failed != test.failed {
+				t.Errorf("%s %v: the job failed: %v", phase, test, j.failure())
+			}
+			if task.skipped != test.skipped || test.skipped && task.state != Completed {
+				t.Errorf("%s %v: the task is %v, skipped %v", phase, test, task.state, task.skipped)
+			}
+		}
+	}
+}
+
+func TestOneReduceAttemptCommits(t *testing.T) {
+	quietLog(t)
+	c := newTestController()
+	j := newTestJob(t, c, testJobSpec(1, 1, 4))
+	task := j.reduceTasks[0]
+	task.assignTask("worker-1")
+	task.assignTask("worker-2")
+	dir := t.TempDir()
+	format, _ := output.Lookup(output.Text)
+
+	commit := func(attempt int) bool {
+		response := CanCommitReduceTaskResponse{}
+		request := CanCommitReduceTaskRequest{WorkerId: "worker-1", JobId: j.id, TaskId: 0, Attempt: attempt}
+		if err := c.CanCommitReduceTask(&request, &response); err != nil {
+			t.Fatal(err)
+		}
+		file, err := output.Create(dir, reduceOutputName(0), format, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Write("attempt", fmt.Sprint(attempt))
+		committed, err := commitOutput(file, response.Allowed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return committed
+	}
+	fail := func(attempt int) {
+		request := ReportTaskFailureRequest{
+			WorkerId: "worker-1", JobId: j.id, Phase: ReducePhase, TaskId: 0, Attempt: attempt, Error: "failed",
+		}
+		if err := c.ReportTaskFailure(&request, &ReportTaskFailureResponse{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	steps := []struct {
+		name      string
+		run       func() bool
+		committed bool
+		output    string //content of the output file afterwards
+	}{
+		{"first attempt asking", func() bool { return commit(2) }, true, "attempt 2\n"},
+		{"other attempt while it commits", func() bool { return commit(1) }, false, "attempt 2\n"},
+		{"committing attempt asking again", func() bool { return commit(2) }, true, "attempt 2\n"},
+		{"other attempt after it failed", func() bool { fail(2); return commit(1) }, true, "attempt 1\n"},
+		{"failed attempt", func() bool { return commit(2) }, false, "attempt 1\n"},
+		{"completed attempt", func() bool { return reportCompletion(t, c, j, ReducePhase, 0, 1) && commit(1) }, true, "attempt 1\n"},
+		{"unknown attempt", func() bool { return commit(3) }, false, "attempt 1\n"},
+	}
+	for _, step := range steps {
+		if committed := step.run(); committed != step.committed {
+			t.Errorf("%s: committed %v", step.name, committed)
+		}
+		content, err := ioutil.ReadFile(filepath.Join(dir, reduceOutputName(0)))
+		if err != nil || string(content) != step.output {
+			t.Errorf("%s: the output is %q, err: %v", step.name, content, err)
+		}
+		//only the committed output remains, the discarded ones were removed
+		if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+			t.Errorf("%s: %d files in the output directory", step.name, len(files))
+		}
+	}
+}
@@ -0,0 +1,642 @@
+package distributed
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"gomr.com/gomr/mr"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+/**
+External merge sort of the intermediate KeyValue data.
+
+Map side: the partitioned output is buffered up to a bounded number of bytes, the keys and
+values and a fixed overhead per record. When the buffer is full every partition is sorted and spilled to disk as a sorted run.
+At the end the runs of a partition are merged into the final sorted mr-<map>-<reduce> file.
+
+Reduce side: the sorted files of every map task are merged with a streaming k-way merge and
+handed to the reduce function one key group at a time.
+
+At most mergeFactor files are open at once, more runs are first merged in several passes.
+*/
+
+const (
+	//bytes buffered by a map task before spilling a sorted run, see bufferedSize
+	DefaultSortBufferSize int64 = 64 << 20
+
+	//memory of a buffered record besides its key and value: the KeyValue of two string headers
+	//and the spare capacity of the slices holding it
+	recordOverhead = 48
+
+	mergeFactor = 64
+)
+
+/**
+Returns the bytes of memory a buffered record is counted with against the sort buffer.
+*/
+func bufferedSize(kv mr.KeyValue) int64 {
+	return int64(len(kv.Key)+len(kv.Value)) + recordOverhead
+}
+
+/**
+Iterates over KeyValue records, returns io.EOF after the last record.
+*/
+type kvIterator interface {
+	Next() (mr.KeyValue, error)
+}
+
+/**
+Reads a file of KeyValue records in any of the intermediate formats.
+*/
+type runReader struct {
+	file    *os.File
+	records kvIterator
+}
+
+func openRun(path string) (*runReader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	records, err := newKVReader(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("cannot read the run %v, err: %w", path, err)
+	}
+	return &runReader{file: file, records: records}, nil
+}
+
+func (r *runReader) Next() (mr.KeyValue, error) {
+	return r.records.Next()
+}
+
+func (r *runReader) Close() error {
+	return r.file.Close()
+}
+
+/**
+Writes the sorted records into a new run file.
+*/
+func writeRun(path string, kvs []mr.KeyValue, format kvFormat) error {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	err = writeRecords(kvs, file, format)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+/**
+Writes the records into the output writer in the intermediate format.
+*/
+func writeRecords(kvs []mr.KeyValue, output io.Writer, format kvFormat) error {
+	writer, err := format.newWriter(output)
+	if err != nil {
+		return err
+	}
+	for i := range kvs {
+		if err := writer.Write(&kvs[i]); err != nil {
+			return err
+		}
+	}
+	return writer.Close()
+}
+
+/**
+Heap of the current head record of each merged iterator.
+*/
+type mergeEntry struct {
+	kv     mr.KeyValue
+	source int
+}
+
+type mergeHeap []mergeEntry
+
+func (h mergeHeap) Len() int { return len(h) }
+
+func (h mergeHeap) Less(i, j int) bool {
+	if h[i].kv.Key == h[j].kv.Key {
+		//keep the merge stable, records of earlier sources first
+		return h[i].source < h[j].source
+	}
+	return h[i].kv.Key < h[j].kv.Key
+}
+
+func (h mergeHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *mergeHeap) Push(x interface{}) { *h = append(*h, x.(mergeEntry)) }
+
+func (h *mergeHeap) Pop() interface{} {
+	old := *h
+	entry := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return entry
+}
+
+/**
+Merges sorted iterators into a single sorted iterator.
+*/
+type mergeIterator struct {
+	sources []kvIterator
+	heap    mergeHeap
+	started bool
+}
+
+func newMergeIterator(sources []kvIterator) *mergeIterator {
+	return &mergeIterator{sources: sources}
+}
+
+func (m *mergeIterator) advance(source int) error {
+	kv, err := m.sources[source].Next()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	heap.Push(&m.heap, mergeEntry{kv: kv, source: source})
+	return nil
+}
+
+func (m *mergeIterator) Next() (mr.KeyValue, error) {
+	if !m.started {
+		m.started = true
+		for i := range m.sources {
+			if err := m.advance(i); err != nil {
+				return mr.KeyValue{}, err
+			}
+		}
+	}
+	if m.heap.Len() == 0 {
+		return mr.KeyValue{}, io.EOF
+	}
+	entry := heap.Pop(&m.heap).(mergeEntry)
+	if err := m.advance(entry.source); err != nil {
+		return mr.KeyValue{}, err
+	}
+	return entry.kv, nil
+}
+
+/**
+Iterates over an in memory sorted slice.
+*/
+type sliceIterator struct {
+	kvs []mr.KeyValue
+	pos int
+}
+
+func (s *sliceIterator) Next() (mr.KeyValue, error) {
+	if s.pos >= len(s.kvs) {
+		return mr.KeyValue{}, io.EOF
+	}
+	s.pos++
+	return s.kvs[s.pos-1], nil
+}
+
+/**
+Groups the records of a sorted iterator by key.
+*/
+type groupIterator struct {
+	source  kvIterator
+	pending *mr.KeyValue
+	done    bool
+}
+
+func newGroupIterator(source kvIterator) *groupIterator {
+	return &groupIterator{source: source}
+}
+
+/**
+Returns the next key with all its values, io.EOF after the last key.
+*/
+func (g *groupIterator) NextGroup() (string, []string, error) {
+	if g.pending == nil {
+		if g.done {
+			return "", nil, io.EOF
+		}
+		kv, err := g.source.Next()
+		if err != nil {
+			g.done = true
+			return "", nil, err
+		}
+		g.pending = &kv
+	}
+	key := g.pending.Key
+	values := []string{g.pending.Value}
+	g.pending = nil
+	for {
+		kv, err := g.source.Next()
+		if err == io.EOF {
+			g.done = true
+			break
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		if kv.Key != key {
+			g.pending = &kv
+			break
+		}
+		values = append(values, kv.Value)
+	}
+	return key, values, nil
+}
+
+/**
+Groups the records of unsorted iterators by key in memory. The groups are returned
+in no particular order.
+
+At most limit bytes are grouped, counted like the sort buffer, see bufferedSize. load fails
+with errGroupLimit for larger partitions, which are sorted on disk instead, see sortRuns.
+*/
+type hashGroupIterator struct {
+	sources []kvIterator
+	limit   int64
+	keys    []string
+	groups  map[string][]string
+	loaded  bool
+}
+
+var errGroupLimit = errors.New("the partition does not fit into the memory limit")
+
+func newHashGroupIterator(sources []kvIterator, limit int64) *hashGroupIterator {
+	if limit <= 0 {
+		limit = DefaultSortBufferSize
+	}
+	return &hashGroupIterator{sources: sources, limit: limit, groups: make(map[string][]string)}
+}
+
+func (h *hashGroupIterator) load() error {
+	h.loaded = true
+	size := int64(0)
+	for _, source := range h.sources {
+		for {
+			kv, err := source.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			if _, ok := h.groups[kv.Key]; !ok {
+				h.keys = append(h.keys, kv.Key)
+				size += int64(len(kv.Key))
+			}
+			h.groups[kv.Key] = append(h.groups[kv.Key], kv.Value)
+			size += int64(len(kv.Value)) + recordOverhead
+			if size > h.limit {
+				h.keys = nil
+				h.groups = nil
+				return errGroupLimit
+			}
+		}
+	}
+	return nil
+}
+
+func (h *hashGroupIterator) NextGroup() (string, []string, error) {
+	if !h.loaded {
+		if err := h.load(); err != nil {
+			return "", nil, err
+		}
+	}
+	if len(h.keys) == 0 {
+		return "", nil, io.EOF
+	}
+	key := h.keys[0]
+	h.keys = h.keys[1:]
+	values := h.groups[key]
+	delete(h.groups, key)
+	return key, values, nil
+}
+
+/**
+Iterates over the key groups of a reduce partition, io.EOF after the last one.
+*/
+type keyGroupIterator interface {
+	NextGroup() (string, []string, error)
+}
+
+/**
+Merges the sorted run files into the output writer, combining the values of
+each key if combine is not nil.
+*/
+func mergeRunsTo(runs []string, output io.Writer, combine func(string, []string) string, format kvFormat) error {
+	readers := make([]*runReader, 0, len(runs))
+	defer func() {
+		for _, r := range readers {
+			r.Close()
+		}
+	}()
+	sources := make([]kvIterator, 0, len(runs))
+	for _, run := range runs {
+		r, err := openRun(run)
+		if err != nil {
+			return err
+		}
+		readers = append(readers, r)
+		sources = append(sources, r)
+	}
+
+	writer, err := format.newWriter(output)
+	if err != nil {
+		return err
+	}
+	merged := newMergeIterator(sources)
+	if combine != nil {
+		groups := newGroupIterator(merged)
+		for {
+			key, values, err := groups.NextGroup()
+			if err == io.EOF {
+				return writer.Close()
+			}
+			if err != nil {
+				return err
+			}
+			if err := writer.Write(&mr.KeyValue{Key: key, Value: combine(key, values)}); err != nil {
+				return err
+			}
+		}
+	}
+	if err := copyRecords(merged, writer); err != nil {
+		return err
+	}
+	return writer.Close()
+}
+
+/**
+Writes the records of the iterator into the writer.
+*/
+func copyRecords(records kvIterator, writer kvWriter) error {
+	for {
+		kv, err := records.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := writer.Write(&kv); err != nil {
+			return err
+		}
+	}
+}
+
+/**
+Merges the runs in passes until at most mergeFactor of them are left.
+The intermediate runs are written into tmpDir.
+*/
+func reduceRuns(runs []string, tmpDir string, combine func(string, []string) string, format kvFormat) ([]string, error) {
+	for pass := 0; len(runs) > mergeFactor; pass++ {
+		merged := []string{}
+		for i := 0; i < len(runs); i += mergeFactor {
+			end := i + mergeFactor
+			if end > len(runs) {
+				end = len(runs)
+			}
+			file, err := ioutil.TempFile(tmpDir, "merge-")
+			if err != nil {
+				return nil, err
+			}
+			err = mergeRunsTo(runs[i:end], file, combine, format)
+			file.Close()
+			if err != nil {
+				return nil, err
+			}
+			merged = append(merged, file.Name())
+		}
+		log.Printf("Merge pass %d reduced %d runs to %d", pass, len(runs), len(merged))
+		runs = merged
+	}
+	return runs, nil
+}
+
+/**
+Sorts the records of unsorted runs into sorted runs in tmpDir, buffering at most bufferSize
+bytes of records in memory.
+*/
+func sortRuns(runs []string, tmpDir string, bufferSize int64, format kvFormat) ([]string, error) {
+	sorter := newSpillSorter(1, bufferSize, true, nil, format)
+	sorter.tmpDir = tmpDir
+	for _, run := range runs {
+		r, err := openRun(run)
+		if err != nil {
+			return nil, err
+		}
+		for {
+			kv, err := r.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				r.Close()
+				return nil, err
+			}
+			if err := sorter.add(0, kv); err != nil {
+				r.Close()
+				return nil, err
+			}
+		}
+		r.Close()
+	}
+	if err := sorter.spill(); err != nil {
+		return nil, err
+	}
+	return sorter.runs[0], nil
+}
+
+/**
+Map side sorter. Buffers the partitioned records and spills sorted runs to disk
+once bufferSize bytes are buffered, see bufferedSize.
+
+Without sorting (see --no-sort) the runs are spilled in arrival order and concatenated.
+
+With a combiner the values of a key are combined in every spilled run and again while the
+runs are merged, so that each key appears once per run and once in the final file.
+*/
+type spillSorter struct {
+	nReduce    int
+	bufferSize int64
+	sorted     bool
+	format     kvFormat //intermediate format of the runs and the partitions
+	combine    func(string, []string) string
+	buffered   int64 //bytes of the buffered records, see bufferedSize
+	records    int   //buffered records
+	partitions [][]mr.KeyValue
+	runs       [][]string //spilled run files of each partition
+	tmpDir     string
+}
+
+func newSpillSorter(
+	nReduce int, bufferSize int64, sorted bool, combine func(string, []string) string, format kvFormat,
+) *spillSorter {
+	if bufferSize <= 0 {
+		bufferSize = DefaultSortBufferSize
+	}
+	return &spillSorter{
+		nReduce:    nReduce,
+		bufferSize: bufferSize,
+		sorted:     sorted,
+		format:     format,
+		combine:    combine,
+		partitions: make([][]mr.KeyValue, nReduce),
+		runs:       make([][]string, nReduce),
+	}
+}
+
+func (s *spillSorter) add(partition int, kv mr.KeyValue) error {
+	s.partitions[partition] = append(s.partitions[partition], kv)
+	s.buffered += bufferedSize(kv)
+	s.records++
+	if s.buffered >= s.bufferSize {
+		return s.spill()
+	}
+	return nil
+}
+
+func (s *spillSorter) spill() error {
+	if s.tmpDir == "" {
+		tmpDir, err := ioutil.TempDir("", "gomr-spill-")
+		if err != nil {
+			return err
+		}
+		s.tmpDir = tmpDir
+	}
+	for i, kvs := range s.partitions {
+		if len(kvs) == 0 {
+			continue
+		}
+		kvs = s.prepare(kvs)
+		path := filepath.Join(s.tmpDir, fmt.Sprintf("run-%d-%d", i, len(s.runs[i])))
+		if err := writeRun(path, kvs, s.format); err != nil {
+			return err
+		}
+		s.runs[i] = append(s.runs[i], path)
+		s.partitions[i] = nil
+	}
+	log.Printf("Spilled %d records of %d bytes into sorted runs", s.records, s.buffered)
+	s.buffered = 0
+	s.records = 0
+	return nil
+}
+
+/**
+Writes the sorted records of the partition into the output writer.
+*/
+func (s *spillSorter) writePartition(partition int, output io.Writer) error {
+	if len(s.runs[partition]) == 0 {
+		//the records are released, a later spill of the other partitions does not write them again
+		kvs := s.partitions[partition]
+		s.partitions[partition] = nil
+		for _, kv := range kvs {
+			s.buffered -= bufferedSize(kv)
+		}
+		s.records -= len(kvs)
+		return writeRecords(s.prepare(kvs), output, s.format)
+	}
+	if len(s.partitions[partition]) > 0 {
+		if err := s.spill(); err != nil {
+			return err
+		}
+	}
+	if !s.sorted {
+		return concatRunsTo(s.runs[partition], output, s.format)
+	}
+	runs, err := reduceRuns(s.runs[partition], s.tmpDir, s.combine, s.format)
+	if err != nil {
+		return err
+	}
+	return mergeRunsTo(runs, output, s.combine, s.format)
+}
+
+/**
+Sorts and combines the buffered records of a partition before they are written.
+*/
+func (s *spillSorter) prepare(kvs []mr.KeyValue) []mr.KeyValue {
+	if s.sorted {
+		sort.Stable(mr.SortKey(kvs))
+	}
+	if s.combine == nil {
+		return kvs
+	}
+	if s.sorted {
+		return combineSorted(kvs, s.combine)
+	}
+	return combineUnsorted(kvs, s.combine)
+}
+
+/**
+Combines the values of the adjacent records with the same key.
+*/
+func combineSorted(kvs []mr.KeyValue, combine func(string, []string) string) []mr.KeyValue {
+	combined := []mr.KeyValue{}
+	for i := 0; i < len(kvs); {
+		j := i
+		values := []string{}
+		for ; j < len(kvs) && kvs[i].Key == kvs[j].Key; j++ {
+			values = append(values, kvs[j].Value)
+		}
+		combined = append(combined, mr.KeyValue{Key: kvs[i].Key, Value: combine(kvs[i].Key, values)})
+		i = j
+	}
+	return combined
+}
+
+/**
+Combines the values of the records with the same key, keeping the order the keys first appear in.
+*/
+func combineUnsorted(kvs []mr.KeyValue, combine func(string, []string) string) []mr.KeyValue {
+	keys := []string{}
+	groups := make(map[string][]string)
+	for _, kv := range kvs {
+		if _, ok := groups[kv.Key]; !ok {
+			keys = append(keys, kv.Key)
+		}
+		groups[kv.Key] = append(groups[kv.Key], kv.Value)
+	}
+	combined := make([]mr.KeyValue, 0, len(keys))
+	for _, key := range keys {
+		combined = append(combined, mr.KeyValue{Key: key, Value: combine(key, groups[key])})
+	}
+	return combined
+}
+
+/**
+Writes the records of the runs one run after the other into the output writer.
+*/
+func concatRunsTo(runs []string, output io.Writer, format kvFormat) error {
+	writer, err := format.newWriter(output)
+	if err != nil {
+		return err
+	}
+	for _, run := range runs {
+		r, err := openRun(run)
+		if err != nil {
+			return err
+		}
+		err = copyRecords(r, writer)
+		r.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return writer.Close()
+}
+
+/**
+Removes the spilled runs.
+*/
+func (s *spillSorter) close() {
+	if s.tmpDir != "" {
+		os.RemoveAll(s.tmpDir)
+	}
+}
@@ -0,0 +1,163 @@
+package distributed
+
+import (
+	"bytes"
+	"fmt"
+	"gomr.com/gomr/codec"
+	"gomr.com/gomr/mr"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+/**
+Writes n sorted runs into dir, run i holds the keys k < keys with
+k % n == i, and the keys below 3 which are in every run.
+*/
+func writeTestRuns(t *testing.T, dir string, n int, keys int, format kvFormat) ([]string, []mr.KeyValue) {
+	t.Helper()
+	runs := []string{}
+	all := []mr.KeyValue{}
+	for i := 0; i < n; i++ {
+		kvs := []mr.KeyValue{}
+		for k := 0; k < keys; k++ {
+			if k%n == i || k < 3 {
+				kvs = append(kvs, mr.KeyValue{Key: fmt.Sprintf("%06d", k), Value: "1"})
+			}
+		}
+		path := filepath.Join(dir, fmt.Sprintf("run-%d", i))
+		if err := writeRun(path, kvs, format); err != nil {
+			t.Fatal(err)
+		}
+		runs = append(runs, path)
+		all = append(all, kvs...)
+	}
+	sort.SliceStable(all, func(i, j int) bool { return all[i].Key < all[j].Key })
+	return runs, all
+}
+
+func mergeTestRuns(t *testing.T, runs []string, combine func(string, []string) string, format kvFormat) []mr.KeyValue {
+	t.Helper()
+	reduced, err := reduceRuns(runs, t.TempDir(), combine, format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reduced) > mergeFactor {
+		t.Fatalf("%d runs left after reducing %d, at most %d expected", len(reduced), len(runs), mergeFactor)
+	}
+	var output bytes.Buffer
+	if err := mergeRunsTo(reduced, &output, combine, format); err != nil {
+		t.Fatal(err)
+	}
+	kvs, err := decodeRecords(output.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kvs
+}
+
+func TestMergeManyRuns(t *testing.T) {
+	for _, name := range IntermediateFormatNames() {
+		format, err := newKVFormat(name, codec.None)
+		if err != nil {
+			t.Fatal(err)
+		}
+		//two merge passes
+		n := mergeFactor*mergeFactor + 3
+		runs, expected := writeTestRuns(t, t.TempDir(), n, 2*n, format)
+		merged := mergeTestRuns(t, runs, nil, format)
+		if len(merged) != len(expected) {
+			t.Fatalf("%s: merged %d records, expected %d", name, len(merged), len(expected))
+		}
+		for i := range merged {
+			if merged[i].Key != expected[i].Key {
+				t.Fatalf("%s: record %d has key %q, expected %q", name, i, merged[i].Key, expected[i].Key)
+			}
+		}
+	}
+}
+
+func TestMergeManyRunsCombined(t *testing.T) {
+	format, err := newKVFormat(IntermediateBinary, codec.None)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 3*mergeFactor + 1
+	runs, expected := writeTestRuns(t, t.TempDir(), n, 5*n, format)
+	counts := map[string]int{}
+	for _, kv := range expected {
+		counts[kv.Key]++
+	}
+	sum := func(key string, values []string) string {
+		total := 0
+		for _, value := range values {
+			count, _ := strconv.Atoi(value)
+			total += count
+		}
+		return strconv.Itoa(total)
+	}
+	merged := mergeTestRuns(t, runs, sum, format)
+	if len(merged) != len(counts) {
+		t.Fatalf("merged %d keys, expected %d", len(merged), len(counts))
+	}
+	for i, kv := range merged {
+		if i > 0 && merged[i-1].Key >= kv.Key {
+			t.Fatalf("key %q follows %q", kv.Key, merged[i-1].Key)
+		}
+		if kv.Value != strconv.Itoa(counts[kv.Key]) {
+			t.Fatalf("key %q counts %s, expected %d", kv.Key, kv.Value, counts[kv.Key])
+		}
+	}
+}
+
+func TestSpillSorterCountsRecordOverhead(t *testing.T) {
+	format, _ := newKVFormat(IntermediateBinary, codec.None)
+	records := 100
+	sorter := newSpillSorter(1, int64(records)*(2+recordOverhead), true, nil, format)
+	defer sorter.close()
+	for i := 0; i < records; i++ {
+		if err := sorter.add(0, mr.KeyValue{Key: "k", Value: "v"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(sorter.runs[0]) != 1 {
+		t.Fatalf("%d runs spilled for %d small records filling the buffer, expected 1", len(sorter.runs[0]), records)
+	}
+}
+
+func TestWritePartitionReleasesRecords(t *testing.T) {
+	format, _ := newKVFormat(IntermediateBinary, codec.None)
+	sorter := newSpillSorter(2, 10*bufferedSize(mr.KeyValue{Key: "k", Value: "v"}), true, nil, format)
+	defer sorter.close()
+	//partition 1 spills a run, partition 0 only has buffered records
+	for i := 0; i < 10; i++ {
+		if err := sorter.add(1, mr.KeyValue{Key: "k", Value: "v"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sorter.add(0, mr.KeyValue{Key: "a", Value: "1"})
+	sorter.add(1, mr.KeyValue{Key: "b", Value: "2"})
+
+	var partitions [2]bytes.Buffer
+	for i := range partitions {
+		if err := sorter.writePartition(i, &partitions[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(sorter.runs[0]) != 0 {
+		t.Fatalf("the written records of partition 0 were spilled into %d runs", len(sorter.runs[0]))
+	}
+	if sorter.buffered != 0 || sorter.records != 0 {
+		t.Fatalf("%d records of %d bytes still buffered", sorter.records, sorter.buffered)
+	}
+	for i, expected := range []int{1, 11} {
+		kvs, err := decodeRecords(partitions[i].Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(kvs) != expected {
+			t.Fatalf("partition %d has %d records, expected %d", i, len(kvs), expected)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package distributed
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+/**
+Phases of a job, identify the task of a failure report.
+*/
+const (
+	MapPhase    = "map"
+	ReducePhase = "reduce"
+)
+
+/**
+What the controller does with a task once maxAttempts of its attempts failed.
+*/
+const (
+	FailJob  = "fail" //the job fails, the default
+	SkipTask = "skip" //the task is skipped: a map task contributes no records, a reduce task no output
+
+	DefaultMaxAttempts = 4
+)
+
+type attemptStatus string
+
+const (
+	attemptRunning   attemptStatus = "running"
+	attemptSucceeded attemptStatus = "succeeded"
+	attemptFailed    attemptStatus = "failed"
+	attemptTimedOut  attemptStatus = "timed out"
+	attemptReleased  attemptStatus = "released" //the worker stopped, does not count as a failure
+	attemptKilled    attemptStatus = "killed"   //another attempt completed the task first
+	attemptLost      attemptStatus = "lost"     //the map output of the succeeded attempt can no longer be fetched
+	attemptAborted   attemptStatus = "aborted"  //a reduce attempt could not fetch a map output, does not count as a failure
+	attemptRefused   attemptStatus = "refused"  //the worker cannot load the plugin of the job, does not count as a failure
+)
+
+/**
+History entry of an attempt of a task.
+*/
+type taskAttempt struct {
+	number    int
+	workerId  string
+	start     time.Time
+	renewTime time.Time //start of the current lease, renewed by the worker heartbeats
+	end       time.Time
+	status    attemptStatus
+	err       string
+}
+
+func (a *taskAttempt) String() string {
+	s := fmt.Sprintf("attempt %d on %s %s", a.number, a.workerId, a.status)
+	if !a.end.IsZero() {
+		s += fmt.Sprintf(" after %v", a.end.Sub(a.start).Round(time.Millisecond))
+	}
+	if a.err != "" {
+		s += ": " + a.err
+	}
+	return s
+}
+
+/**
+Ends the attempt if it is still running.
+*/
+func (a *taskAttempt) finish(status attemptStatus, err string) {
+	if a.status != attemptRunning {
+		return
+	}
+	a.status = status
+	a.end = time.Now()
+	a.err = err
+}
+
+/**
+Number of attempts which failed or timed out.
+*/
+func (t *task) failedAttempts() int {
+	failed := 0
+	for _, a := range t.attempts {
+		if a.status == attemptFailed || a.status == attemptTimedOut {
+			failed++
+		}
+	}
+	return failed
+}
+
+func (c *Controller) ReportTaskFailure(request *ReportTaskFailureRequest, response *ReportTaskFailureResponse) error {
+	log.Printf(
+		"Handling failure of %s task: %d attempt %d of job %s by %s, err: %s", request.Phase, request.TaskId,
+		request.Attempt, request.JobId, request.WorkerId, request.Error,
+	)
+	j, err := c.job(request.JobId)
+	if err != nil {
+		return err
+	}
+	if request.Phase != MapPhase && request.Phase != ReducePhase {
+		return fmt.Errorf("unknown phase %q", request.Phase)
+	}
+	t, ok := j.tasks(request.Phase)[request.TaskId]
+	if !ok {
+		return fmt.Errorf("unknown %s task %d of job %s", request.Phase, request.TaskId, request.JobId)
+	}
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	a := t.runningAttempt(request.Attempt)
+	if t.state != Assigned || a == nil {
+		log.Printf("Ignoring the failure of the stale attempt %d of %s task: %d", request.Attempt, request.Phase, request.TaskId)
+		return nil
+	}
+	j.workers.assignTask(request.Phase, a.workerId, TaskRef{JobId: j.id, TaskId: request.TaskId}, false)
+	if request.Refused {
+		//the task is not to blame, it is handed to the other workers
+		a.finish(attemptRefused, request.Error)
+		j.workers.refuseJob(a.workerId, j.id)
+		if len(t.running()) == 0 {
+			t.state = Unassigned
+		}
+	} else {
+		a.finish(attemptFailed, request.Error)
+		if len(t.running()) == 0 {
+			//a backup attempt may still complete the task
+			j.retryOrGiveUp(request.Phase, request.TaskId, t)
+		}
+	}
+	j.journalTask(request.Phase, request.TaskId, t)
+	return nil
+}
+
+/**
+Decides what happens to a task whose last running attempt failed or timed out: it is retried until
+maxAttempts attempts failed, then the failure policy either skips it or fails the job.
+The task lock is held by the caller.
+*/
+func (j *job) retryOrGiveUp(phase string, taskId int, t *task) {
+	failed := t.failedAttempts()
+	if failed < j.maxAttempts {
+		log.Printf("Retrying %s task %d of job %s, %d of %d attempts failed", phase, taskId, j.id, failed, j.maxAttempts)
+		t.state = Unassigned
+		return
+	}
+	lastErr := ""
+	for _, a := range t.attempts {
+		if a.status == attemptFailed || a.status == attemptTimedOut {
+			lastErr = a.err
+		}
+	}
+	if j.failurePolicy == SkipTask {
+		log.Printf("Skipping %s task %d of job %s after %d failed attempts, last err: %s", phase, taskId, j.id, failed, lastErr)
+		t.state = Completed
+		t.skipped = true
+		t.accepted = 0
+		return
+	}
+	log.Printf("Failing the job %s, %s task %d failed %d attempts, last err: %s", j.id, phase, taskId, failed, lastErr)
+	t.state = Unassigned
+	j.fail(fmt.Errorf("%s task %d failed %d attempts, last err: %s", phase, taskId, failed, lastErr))
+}
+
+func (j *job) fail(err error) {
+	j.mx.Lock()
+	failed := j.err == nil
+	if failed {
+		j.journal.append(journalRecord{Failed: err.Error()})
+		j.err = err
+	}
+	j.mx.Unlock()
+	if failed {
+		j.ended()
+	}
+}
+
+/**
+Returns why the job failed, nil unless a task failed too many attempts under the FailJob policy.
+*/
+func (j *job) failure() error {
+	j.mx.Lock()
+	defer j.mx.Unlock()
+	return j.err
+}
+
+/**
+Summarizes the tasks which had failed attempts with the history of their attempts, empty if
+no attempt failed.
+*/
+func (j *job) failureSummary() string {
+	var b strings.Builder
+	summarize := func(phase string, tasks map[int]*task) {
+		taskIds := []int{}
+		for taskId := range tasks {
+			taskIds = append(taskIds, taskId)
+		}
+		sort.Ints(taskIds)
+		for _, taskId := range taskIds {
+			t := tasks[taskId]
+			t.mx.Lock()
+			if t.failedAttempts() > 0 {
+				outcome := string(t.state)
+				if t.skipped {
+					outcome = "skipped"
+				} else if t.state != Completed && t.failedAttempts() >= j.maxAttempts {
+					outcome = "failed"
+				}
+				fmt.Fprintf(&b, "%s task %d", phase, taskId)
+				if phase == MapPhase {
+					fmt.Fprintf(&b, " (%v)", t.split)
+				}
+				fmt.Fprintf(&b, ": %s\n", outcome)
+				for _, a := range t.attempts {
+					fmt.Fprintf(&b, "  %v\n", a)
+				}
+			}
+			t.mx.Unlock()
+		}
+	}
+	summarize(MapPhase, j.mapTasks)
+	summarize(ReducePhase, j.reduceTasks)
+	return b.String()
+}
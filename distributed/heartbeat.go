@@ -0,0 +1,123 @@
+package distributed
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+/**
+Interval of the worker heartbeats. The task timeouts of the controller should be a
+few intervals long, so that a late heartbeat does not expire a lease.
+*/
+const heartbeatInterval = 1 * time.Second
+
+/**
+How long the controller waits for a heartbeat of a worker by default before it removes the
+worker and runs the map tasks again whose output the worker served.
+*/
+const DefaultWorkerTimeout = 10 * time.Second
+
+/**
+Sends periodic heartbeats with the tasks the worker currently holds, which tells the
+controller the worker is alive and renews the leases of the tasks. The controller answers with
+the jobs which ended, their map outputs are removed.
+*/
+type heartbeater struct {
+	client      *rpcClient
+	mx          sync.Mutex
+	workerId    string
+	mapTasks    map[TaskRef]bool
+	reduceTasks map[TaskRef]bool
+	stop        chan struct{}
+	stopped     sync.WaitGroup
+}
+
+func newHeartbeater(addr string) *heartbeater {
+	return &heartbeater{
+		//a heartbeat is only useful if it arrives in time, do not retry it for longer than the interval
+		client:      newRPCClient(addr, heartbeatInterval),
+		mapTasks:    make(map[TaskRef]bool),
+		reduceTasks: make(map[TaskRef]bool),
+		stop:        make(chan struct{}),
+	}
+}
+
+func (h *heartbeater) setWorkerId(workerId string) {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	h.workerId = workerId
+}
+
+func (h *heartbeater) holdMapTask(ref TaskRef, held bool) {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	if held {
+		h.mapTasks[ref] = true
+	} else {
+		delete(h.mapTasks, ref)
+	}
+}
+
+func (h *heartbeater) holdReduceTask(ref TaskRef, held bool) {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	if held {
+		h.reduceTasks[ref] = true
+	} else {
+		delete(h.reduceTasks, ref)
+	}
+}
+
+func (h *heartbeater) request() HeartbeatRequest {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	request := HeartbeatRequest{WorkerId: h.workerId}
+	for ref := range h.mapTasks {
+		request.MapTasks = append(request.MapTasks, ref)
+	}
+	for ref := range h.reduceTasks {
+		request.ReduceTasks = append(request.ReduceTasks, ref)
+	}
+	return request
+}
+
+func (h *heartbeater) start() {
+	h.stopped.Add(1)
+	go func() {
+		defer h.stopped.Done()
+		ticker := time.NewTicker(heartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-h.stop:
+				return
+			case <-ticker.C:
+			}
+			request := h.request()
+			if request.WorkerId == "" {
+				continue
+			}
+			response := HeartbeatResponse{}
+			err := h.client.call("Controller.Heartbeat", &request, &response)
+			if errors.Is(err, ErrJobDone) {
+				return
+			}
+			if errors.Is(err, ErrUnknownWorker) {
+				//the worker registers again with its next task request
+				log.Printf("Controller does not know %s", request.WorkerId)
+			} else if err != nil {
+				log.Printf("Failed to send the heartbeat, err: %v", err)
+			}
+			for _, jobId := range response.EndedJobs {
+				removeJobMapOutputs(jobId)
+			}
+		}
+	}()
+}
+
+func (h *heartbeater) close() {
+	close(h.stop)
+	h.stopped.Wait()
+}
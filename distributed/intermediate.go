@@ -0,0 +1,399 @@
+package distributed
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gomr.com/gomr/codec"
+	"gomr.com/gomr/mr"
+	"hash/crc32"
+	"io"
+)
+
+/**
+Formats of the intermediate KeyValue files, the map outputs and the sorted runs.
+
+binary: the header, the magic "GOMRKV" and a version byte, followed by blocks of records and
+the trailer. A block is its length and the CRC-32C of its records, each 4 bytes big endian,
+followed by the records. A record is the uvarint length of its key, the key, the uvarint
+length of its value and the value. The trailer is a block of length 0 whose checksum covers
+the number of records in the file, 8 bytes big endian, which follows it. A file without the
+trailer was truncated.
+
+json: one json encoded KeyValue per line, slower but readable for debugging, followed by the
+trailer, a line with the number of records: {"Records":N}. It has no checksums, a file without
+the trailer or with another number of records was truncated.
+
+Either is compressed with the codec of the job, see codec.NewWriter. Readers detect the codec
+and the format of a file from their headers.
+*/
+const (
+	IntermediateBinary        = "binary"
+	IntermediateJSON          = "json"
+	DefaultIntermediateFormat = IntermediateBinary
+
+	intermediateMagic     = "GOMRKV"
+	intermediateVersion   = 3
+	intermediateBlockSize = 64 * 1024 //bytes of records per block
+	intermediateMaxBlock  = 64 << 20  //larger block lengths are taken as corruption
+	blockHeaderLength     = 8
+)
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+/**
+Returned by the readers for a file which is corrupt or truncated, as opposed to io.EOF at its
+clean end.
+*/
+var errCorruptIntermediate = errors.New("corrupt intermediate data")
+
+/**
+Returns the names of the intermediate formats.
+*/
+func IntermediateFormatNames() []string {
+	return []string{IntermediateBinary, IntermediateJSON}
+}
+
+/**
+Writes KeyValue records into an intermediate file.
+*/
+type kvWriter interface {
+	Write(kv *mr.KeyValue) error
+	//writes the buffered records and ends the compressed stream, the underlying writer stays open
+	Close() error
+}
+
+/**
+The intermediate format and codec of a job, selected with --intermediate-format and
+--intermediate-codec.
+*/
+type kvFormat struct {
+	name  string
+	codec string
+}
+
+func newKVFormat(name string, codecName string) (kvFormat, error) {
+	switch name {
+	case "":
+		name = DefaultIntermediateFormat
+	case IntermediateBinary, IntermediateJSON:
+	default:
+		return kvFormat{}, fmt.Errorf("unknown intermediate format: %q", name)
+	}
+	if codecName == "" {
+		codecName = codec.DefaultCodec
+	}
+	if _, err := codec.Lookup(codecName); err != nil {
+		return kvFormat{}, fmt.Errorf("unable to use the intermediate codec, err: %w", err)
+	}
+	return kvFormat{name: name, codec: codecName}, nil
+}
+
+func (f kvFormat) newWriter(w io.Writer) (kvWriter, error) {
+	compressed, err := codec.NewWriter(w, f.codec)
+	if err != nil {
+		return nil, err
+	}
+	if f.name == IntermediateJSON {
+		return &jsonKVWriter{w: compressed, encoder: json.NewEncoder(compressed)}, nil
+	}
+	return newBlockWriter(compressed)
+}
+
+/**
+Opens a reader of the intermediate records in r, with the codec and in the format given by
+the headers.
+*/
+func newKVReader(r io.Reader) (kvIterator, error) {
+	decompressed, err := codec.NewReader(r)
+	if errors.Is(err, codec.ErrUnknown) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errCorruptIntermediate, err)
+	}
+	buffered := bufio.NewReader(decompressed)
+	magic, _ := buffered.Peek(len(intermediateMagic))
+	if string(magic) != intermediateMagic {
+		//anything else is json, an empty file lacks its trailer
+		return &jsonKVReader{decoder: json.NewDecoder(buffered)}, nil
+	}
+	return newBlockReader(buffered)
+}
+
+/**
+The last line of a file in the json format.
+*/
+type jsonTrailer struct {
+	Records uint64
+}
+
+type jsonKVWriter struct {
+	w       io.WriteCloser
+	encoder *json.Encoder
+	records uint64
+}
+
+func (w *jsonKVWriter) Write(kv *mr.KeyValue) error {
+	if err := w.encoder.Encode(kv); err != nil {
+		return err
+	}
+	w.records++
+	return nil
+}
+
+func (w *jsonKVWriter) Close() error {
+	if err := w.encoder.Encode(jsonTrailer{Records: w.records}); err != nil {
+		return err
+	}
+	return w.w.Close()
+}
+
+/**
+A line of the json format, either a record or the trailer with Records set.
+*/
+type jsonLine struct {
+	Key     string
+	Value   string
+	Records *uint64
+}
+
+/**
+Reads the records of the json format, verifying the trailer.
+*/
+type jsonKVReader struct {
+	decoder *json.Decoder
+	records uint64 //records read so far
+	ended   bool   //the trailer was read
+}
+
+func (r *jsonKVReader) Next() (mr.KeyValue, error) {
+	if r.ended {
+		return mr.KeyValue{}, io.EOF
+	}
+	var line jsonLine
+	if err := r.decoder.Decode(&line); err != nil {
+		if err == io.EOF {
+			return mr.KeyValue{}, fmt.Errorf("%w: the trailer is missing after record %d", errCorruptIntermediate, r.records)
+		}
+		return mr.KeyValue{}, fmt.Errorf("%w: %v", errCorruptIntermediate, err)
+	}
+	if line.Records != nil {
+		return mr.KeyValue{}, r.readTrailer(*line.Records)
+	}
+	r.records++
+	return mr.KeyValue{Key: line.Key, Value: line.Value}, nil
+}
+
+/**
+Verifies the number of records of the trailer and that nothing follows it.
+*/
+func (r *jsonKVReader) readTrailer(records uint64) error {
+	if records != r.records {
+		return fmt.Errorf("%w: read %d records, the trailer counts %d", errCorruptIntermediate, r.records, records)
+	}
+	var next json.RawMessage
+	if err := r.decoder.Decode(&next); err != io.EOF {
+		if err == nil {
+			return fmt.Errorf("%w: data after the trailer", errCorruptIntermediate)
+		}
+		return fmt.Errorf("%w: %v", errCorruptIntermediate, err)
+	}
+	r.ended = true
+	return io.EOF
+}
+
+/**
+Writes the records in blocks of the binary format.
+*/
+type blockWriter struct {
+	w       io.WriteCloser
+	block   []byte //records of the current block
+	records uint64
+}
+
+func newBlockWriter(w io.WriteCloser) (*blockWriter, error) {
+	if _, err := io.WriteString(w, intermediateMagic+string([]byte{intermediateVersion})); err != nil {
+		return nil, err
+	}
+	return &blockWriter{w: w, block: make([]byte, 0, intermediateBlockSize)}, nil
+}
+
+func (w *blockWriter) Write(kv *mr.KeyValue) error {
+	var length [binary.MaxVarintLen64]byte
+	w.block = append(w.block, length[:binary.PutUvarint(length[:], uint64(len(kv.Key)))]...)
+	w.block = append(w.block, kv.Key...)
+	w.block = append(w.block, length[:binary.PutUvarint(length[:], uint64(len(kv.Value)))]...)
+	w.block = append(w.block, kv.Value...)
+	w.records++
+	if len(w.block) >= intermediateBlockSize {
+		return w.flush()
+	}
+	return nil
+}
+
+func (w *blockWriter) flush() error {
+	if len(w.block) == 0 {
+		return nil
+	}
+	var header [blockHeaderLength]byte
+	binary.BigEndian.PutUint32(header[0:4], uint32(len(w.block)))
+	binary.BigEndian.PutUint32(header[4:8], crc32.Checksum(w.block, castagnoliTable))
+	if _, err := w.w.Write(header[:]); err != nil {
+		return err
+	}
+	if _, err := w.w.Write(w.block); err != nil {
+		return err
+	}
+	w.block = w.block[:0]
+	return nil
+}
+
+func (w *blockWriter) Close() error {
+	if err := w.flush(); err != nil {
+		return err
+	}
+	var trailer [blockHeaderLength + 8]byte
+	binary.BigEndian.PutUint64(trailer[blockHeaderLength:], w.records)
+	binary.BigEndian.PutUint32(trailer[4:8], crc32.Checksum(trailer[blockHeaderLength:], castagnoliTable))
+	if _, err := w.w.Write(trailer[:]); err != nil {
+		return err
+	}
+	return w.w.Close()
+}
+
+/**
+Reads the records of the binary format, verifying the checksum of every block and the trailer.
+*/
+type blockReader struct {
+	r       *bufio.Reader
+	blocks  int //blocks read so far
+	block   []byte
+	pos     int
+	records uint64 //records read so far
+	ended   bool   //the trailer was read
+}
+
+func newBlockReader(r *bufio.Reader) (*blockReader, error) {
+	header := make([]byte, len(intermediateMagic)+1)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("%w: truncated header, %v", errCorruptIntermediate, err)
+	}
+	if version := header[len(intermediateMagic)]; version != intermediateVersion {
+		return nil, fmt.Errorf("unsupported intermediate format version %d", version)
+	}
+	return &blockReader{r: r}, nil
+}
+
+/**
+Reads the next block, io.EOF once the trailer was read and verified.
+*/
+func (r *blockReader) readBlock() error {
+	if r.ended {
+		return io.EOF
+	}
+	var header [blockHeaderLength]byte
+	if _, err := io.ReadFull(r.r, header[:]); err != nil {
+		if err == io.EOF {
+			return fmt.Errorf("%w: the trailer is missing after block %d", errCorruptIntermediate, r.blocks)
+		}
+		return fmt.Errorf("%w: truncated header of block %d, %v", errCorruptIntermediate, r.blocks, err)
+	}
+	length := binary.BigEndian.Uint32(header[0:4])
+	if length == 0 {
+		return r.readTrailer(binary.BigEndian.Uint32(header[4:8]))
+	}
+	if length > intermediateMaxBlock {
+		return fmt.Errorf("%w: header of block %d with length %d", errCorruptIntermediate, r.blocks, length)
+	}
+	if cap(r.block) < int(length) {
+		r.block = make([]byte, length)
+	}
+	r.block = r.block[:length]
+	if _, err := io.ReadFull(r.r, r.block); err != nil {
+		return fmt.Errorf("%w: truncated block %d, %v", errCorruptIntermediate, r.blocks, err)
+	}
+	if crc32.Checksum(r.block, castagnoliTable) != binary.BigEndian.Uint32(header[4:8]) {
+		return fmt.Errorf("%w: checksum mismatch of block %d", errCorruptIntermediate, r.blocks)
+	}
+	r.blocks++
+	r.pos = 0
+	return nil
+}
+
+/**
+Verifies the trailer: its checksum, the number of records and that nothing follows it, which
+also makes the codec verify the end of the compressed stream.
+*/
+func (r *blockReader) readTrailer(checksum uint32) error {
+	var count [8]byte
+	if _, err := io.ReadFull(r.r, count[:]); err != nil {
+		return fmt.Errorf("%w: truncated trailer, %v", errCorruptIntermediate, err)
+	}
+	if crc32.Checksum(count[:], castagnoliTable) != checksum {
+		return fmt.Errorf("%w: checksum mismatch of the trailer", errCorruptIntermediate)
+	}
+	if records := binary.BigEndian.Uint64(count[:]); records != r.records {
+		return fmt.Errorf("%w: read %d records, the trailer counts %d", errCorruptIntermediate, r.records, records)
+	}
+	if _, err := r.r.ReadByte(); err != io.EOF {
+		if err == nil {
+			return fmt.Errorf("%w: data after the trailer", errCorruptIntermediate)
+		}
+		return fmt.Errorf("%w: %v", errCorruptIntermediate, err)
+	}
+	r.ended = true
+	r.block = r.block[:0]
+	r.pos = 0
+	return io.EOF
+}
+
+func (r *blockReader) field() (string, error) {
+	length, n := binary.Uvarint(r.block[r.pos:])
+	if n <= 0 || length > uint64(len(r.block)-r.pos-n) {
+		return "", fmt.Errorf("%w: record length in block %d", errCorruptIntermediate, r.blocks-1)
+	}
+	start := r.pos + n
+	r.pos = start + int(length)
+	return string(r.block[start:r.pos]), nil
+}
+
+func (r *blockReader) Next() (mr.KeyValue, error) {
+	for r.pos >= len(r.block) {
+		if err := r.readBlock(); err != nil {
+			return mr.KeyValue{}, err
+		}
+	}
+	key, err := r.field()
+	if err != nil {
+		return mr.KeyValue{}, err
+	}
+	value, err := r.field()
+	if err != nil {
+		return mr.KeyValue{}, err
+	}
+	r.records++
+	return mr.KeyValue{Key: key, Value: value}, nil
+}
+
+/**
+Reads through the intermediate records in r, returns an error wrapping errCorruptIntermediate
+if they are corrupt or truncated.
+*/
+func verifyRecords(r io.Reader) error {
+	records, err := newKVReader(r)
+	if err != nil {
+		return err
+	}
+	for {
+		_, err := records.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
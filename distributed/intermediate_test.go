@@ -0,0 +1,138 @@
+package distributed
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"gomr.com/gomr/codec"
+	"gomr.com/gomr/mr"
+	"io"
+	"testing"
+)
+
+func testRecords(n int) []mr.KeyValue {
+	kvs := []mr.KeyValue{{Key: "", Value: ""}, {Key: "with\nnewline", Value: "\x00\u00ff"}}
+	for i := 0; i < n; i++ {
+		kvs = append(kvs, mr.KeyValue{Key: fmt.Sprintf("key-%06d", i), Value: fmt.Sprint(i)})
+	}
+	return kvs
+}
+
+func encodeRecords(t *testing.T, kvs []mr.KeyValue, format string, codecName string) []byte {
+	t.Helper()
+	f, err := newKVFormat(format, codecName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buffer bytes.Buffer
+	if err := writeRecords(kvs, &buffer, f); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func decodeRecords(data []byte) ([]mr.KeyValue, error) {
+	records, err := newKVReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	kvs := []mr.KeyValue{}
+	for {
+		kv, err := records.Next()
+		if err == io.EOF {
+			return kvs, nil
+		}
+		if err != nil {
+			return kvs, err
+		}
+		kvs = append(kvs, kv)
+	}
+}
+
+func TestIntermediateRoundTrip(t *testing.T) {
+	//enough records for several blocks of the binary format
+	many := testRecords(3 * intermediateBlockSize / 16)
+	for _, format := range IntermediateFormatNames() {
+		for _, codecName := range []string{codec.None, codec.Gzip, codec.Flate} {
+			for _, kvs := range [][]mr.KeyValue{{}, testRecords(3), many} {
+				data := encodeRecords(t, kvs, format, codecName)
+				read, err := decodeRecords(data)
+				if err != nil {
+					t.Fatalf("%s/%s with %d records: %v", format, codecName, len(kvs), err)
+				}
+				if len(read) != len(kvs) {
+					t.Fatalf("%s/%s: read %d records, wrote %d", format, codecName, len(read), len(kvs))
+				}
+				for i := range kvs {
+					if read[i] != kvs[i] {
+						t.Fatalf("%s/%s: record %d is %q, wrote %q", format, codecName, i, read[i], kvs[i])
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestIntermediateBlocks(t *testing.T) {
+	data := encodeRecords(t, testRecords(3*intermediateBlockSize/16), IntermediateBinary, codec.None)
+	records, err := newKVReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		if _, err := records.Next(); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if blocks := records.(*blockReader).blocks; blocks < 2 {
+		t.Fatalf("read %d blocks, expected several", blocks)
+	}
+}
+
+func TestIntermediateTruncated(t *testing.T) {
+	for _, format := range IntermediateFormatNames() {
+		for _, codecName := range []string{codec.None, codec.Gzip} {
+			data := encodeRecords(t, testRecords(5), format, codecName)
+			end := len(data)
+			if format == IntermediateJSON && codecName == codec.None {
+				//the trailer is complete without its final newline
+				end--
+			}
+			for length := 0; length < end; length++ {
+				err := verifyRecords(bytes.NewReader(data[:length]))
+				if !errors.Is(err, errCorruptIntermediate) {
+					t.Fatalf("%s/%s truncated to %d of %d bytes: got %v", format, codecName, length, len(data), err)
+				}
+			}
+			if err := verifyRecords(bytes.NewReader(data)); err != nil {
+				t.Fatalf("%s/%s: %v", format, codecName, err)
+			}
+		}
+	}
+}
+
+func TestIntermediateBitFlip(t *testing.T) {
+	data := encodeRecords(t, testRecords(5), IntermediateBinary, codec.None)
+	for i := len(intermediateMagic) + 1; i < len(data); i++ {
+		for bit := 0; bit < 8; bit++ {
+			flipped := append([]byte{}, data...)
+			flipped[i] ^= 1 << bit
+			err := verifyRecords(bytes.NewReader(flipped))
+			if !errors.Is(err, errCorruptIntermediate) {
+				t.Fatalf("bit %d of byte %d flipped: got %v", bit, i, err)
+			}
+		}
+	}
+}
+
+func TestIntermediateDataAfterTrailer(t *testing.T) {
+	for _, format := range IntermediateFormatNames() {
+		data := encodeRecords(t, testRecords(5), format, codec.None)
+		data = append(data, encodeRecords(t, testRecords(1), IntermediateJSON, codec.None)...)
+		if err := verifyRecords(bytes.NewReader(data)); !errors.Is(err, errCorruptIntermediate) {
+			t.Fatalf("%s: got %v", format, err)
+		}
+	}
+}
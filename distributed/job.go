@@ -0,0 +1,607 @@
+package distributed
+
+import (
+	"fmt"
+	"gomr.com/gomr/codec"
+	"gomr.com/gomr/input"
+	"gomr.com/gomr/output"
+	"gomr.com/gomr/utils"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+Directory of the job directories. The directory of a job, /tmp/gomr/<jobid>, holds its journal,
+the map outputs in map/ and the reduce outputs in output/.
+*/
+const jobsDirName = "/tmp/gomr"
+
+func jobDir(jobId string) string {
+	return filepath.Join(jobsDirName, jobId)
+}
+
+func jobMapDir(jobId string) string {
+	return filepath.Join(jobDir(jobId), "map")
+}
+
+func jobOutputDir(jobId string) string {
+	return filepath.Join(jobDir(jobId), "output")
+}
+
+/**
+Removes the map outputs of the job on this host once it ended, and its directory unless it
+holds other files, e.g. reduce outputs.
+*/
+func removeJobMapOutputs(jobId string) {
+	if err := os.RemoveAll(jobMapDir(jobId)); err != nil {
+		log.Printf("Unable to remove the map outputs of the job %s, err: %v", jobId, err)
+		return
+	}
+	os.Remove(jobDir(jobId))
+	log.Printf("Removed the map outputs of the job %s", jobId)
+}
+
+/**
+States of a job reported by the JobStatus API.
+*/
+const (
+	JobRunning   = "running"
+	JobCompleted = "completed"
+	JobFailed    = "failed"
+)
+
+/**
+Configuration of a job.
+*/
+type JobConfig struct {
+	NumReduce    int    //number of reduce tasks
+	Plugin       []byte //plugin .so file of the job shipped to the workers, nil for the plugin each worker was started with
+	SplitSize    int64  //maximum bytes of input processed by a single map task
+	InputFormat  string //name of the input format, see input.Lookup, "" for the InputFormat of the plugin
+	OutputFormat string //name of the output format, see output.Lookup
+	OutputCodec  string //codec compressing the output files, see codec.Lookup, "" for none
+	NoSort       bool   //skip sorting, the reduce output is not written in key order
+	Partitioner  string //HashPartitioner, RangePartitioner or "" for the plugin's Partition
+	SampleSize   int    //keys sampled for the range partitioner
+
+	IntermediateFormat string //format of the map outputs, see IntermediateFormatNames, "" for the default
+	IntermediateCodec  string //codec compressing the map outputs, see codec.Lookup, "" for none
+
+	MapTimeout      time.Duration //lease of a map task, it is reassigned after no heartbeat renewed it for this long
+	ReduceTimeout   time.Duration //lease of a reduce task, it is reassigned after no heartbeat renewed it for this long
+	AdaptiveTimeout bool          //derive the runtime of a straggler from the observed task durations, see speculate
+
+	MaxAttempts   int    //failed or timed out attempts after which a task is given up
+	FailurePolicy string //FailJob or SkipTask, what happens to a task which is given up
+	NoSpeculation bool   //never start backup attempts of stragglers
+}
+
+/**
+A job of the controller with its map and reduce tasks.
+*/
+type job struct {
+	id                   string
+	submitted            time.Time
+	pluginHash           string //content hash of the plugin, "" if the job has none
+	plugin               []byte
+	inputFormat          string
+	outputFormat         string
+	outputCodec          string
+	noSort               bool
+	intermediate         kvFormat
+	partitioner          string
+	rangeBoundaries      []string
+	mapTimeout           *taskTimeout //lease duration of the map tasks
+	reduceTimeout        *taskTimeout //lease duration of the reduce tasks
+	numReduce            int          //number of reduce tasks
+	numMap               int          //number of map tasks
+	mapTasks             map[int]*task
+	reduceTasks          map[int]*task
+	workers              *workerRegistry //shared by the jobs of the controller
+	maxAttempts          int             //failed attempts after which a task is given up
+	speculative          bool            //start backup attempts of stragglers
+	failurePolicy        string          //FailJob or SkipTask
+	mx                   sync.Mutex
+	err                  error    //why the job failed
+	journal              *journal //write-ahead journal of the task state transitions
+	mapTasksCompleted    bool
+	mapOutputsLost       int //counts the lost map outputs, see isMapTaskCompleted
+	reduceTasksCompleted bool
+	cleanup              sync.Once //removes the files the job no longer needs once it ended
+}
+
+/**
+Creates a job processing the files. The job is journaled in its directory, see jobDir.
+*/
+func newJob(files []string, config JobConfig, workers *workerRegistry) (*job, error) {
+	uuid, err := exec.Command("uuidgen").Output()
+	if err != nil {
+		return nil, fmt.Errorf("unable to generate UUID: %w", err)
+	}
+	if config.NumReduce <= 0 {
+		return nil, fmt.Errorf("the number of reduce tasks must be positive, not %d", config.NumReduce)
+	}
+
+	//the plugin is only run on the controller to sample the range partitioner, the submitter
+	//resolved the InputFormat of the plugin, see resolveInputFormat
+	var plugin *utils.Plugin
+	if len(config.Plugin) > 0 && config.Partitioner == RangePartitioner {
+		plugin, err = openPlugin(config.Plugin)
+		if err != nil {
+			return nil, err
+		}
+	}
+	inputFormat, err := input.Lookup(config.InputFormat)
+	if err != nil {
+		return nil, fmt.Errorf("unable to use the input format, err: %w", err)
+	}
+	if _, err := output.Lookup(config.OutputFormat); err != nil {
+		return nil, fmt.Errorf("unable to use the output format, err: %w", err)
+	}
+	if _, err := codec.Lookup(config.OutputCodec); err != nil {
+		return nil, fmt.Errorf("unable to use the output codec, err: %w", err)
+	}
+	intermediate, err := newKVFormat(config.IntermediateFormat, config.IntermediateCodec)
+	if err != nil {
+		return nil, err
+	}
+	files, err = input.ExpandPaths(files)
+	if err != nil {
+		return nil, fmt.Errorf("unable to expand the input paths, err: %w", err)
+	}
+	splits, err := inputFormat.Splits(files, config.SplitSize)
+	if err != nil {
+		return nil, fmt.Errorf("unable to split the input files, err: %w", err)
+	}
+	log.Printf("Created %d input splits from %d files", len(splits), len(files))
+
+	var rangeBoundaries []string
+	switch config.Partitioner {
+	case "", HashPartitioner:
+	case RangePartitioner:
+		rangeBoundaries, err = sampleBoundaries(plugin, inputFormat, splits, config.NumReduce, config.SampleSize)
+		if err != nil {
+			return nil, fmt.Errorf("unable to sample the range partitioner boundaries, err: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown partitioner: %q", config.Partitioner)
+	}
+	switch config.FailurePolicy {
+	case "":
+		config.FailurePolicy = FailJob
+	case FailJob, SkipTask:
+	default:
+		return nil, fmt.Errorf("unknown failure policy: %q", config.FailurePolicy)
+	}
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = DefaultMaxAttempts
+	}
+
+	hash := ""
+	if len(config.Plugin) > 0 {
+		hash = pluginHash(config.Plugin)
+	}
+	spec := journalJob{
+		Uuid:               strings.TrimSpace(string(uuid)),
+		Submitted:          time.Now(),
+		PluginHash:         hash,
+		InputFormat:        config.InputFormat,
+		OutputFormat:       config.OutputFormat,
+		OutputCodec:        config.OutputCodec,
+		NoSort:             config.NoSort,
+		IntermediateFormat: intermediate.name,
+		IntermediateCodec:  intermediate.codec,
+		Partitioner:        config.Partitioner,
+		RangeBoundaries:    rangeBoundaries,
+		Splits:             splits,
+		NumReduce:          config.NumReduce,
+		MapTimeout:         config.MapTimeout,
+		ReduceTimeout:      config.ReduceTimeout,
+		AdaptiveTimeout:    config.AdaptiveTimeout,
+		MaxAttempts:        config.MaxAttempts,
+		FailurePolicy:      config.FailurePolicy,
+		Speculative:        !config.NoSpeculation,
+	}
+	j := makeJob(spec, workers)
+	j.plugin = config.Plugin
+	if len(j.plugin) > 0 {
+		if err := os.MkdirAll(jobDir(j.id), os.ModePerm); err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(filepath.Join(jobDir(j.id), jobPluginFileName), j.plugin, 0644); err != nil {
+			return nil, fmt.Errorf("unable to keep the plugin in %v, err: %w", jobDir(j.id), err)
+		}
+	}
+	j.journal, err = createJournal(jobDir(j.id))
+	if err != nil {
+		return nil, fmt.Errorf("unable to create the journal in %v, err: %w", jobDir(j.id), err)
+	}
+	j.journal.append(journalRecord{Job: &spec})
+	log.Printf("Created the job %s with %d map and %d reduce tasks in %v", j.id, j.numMap, j.numReduce, jobDir(j.id))
+	return j, nil
+}
+
+/**
+Restarts the job journaled in dir. The completed tasks are kept as long as their output is
+still on disk, the others are handed out again.
+*/
+func resumeJob(dir string, workers *workerRegistry) (*job, error) {
+	journal, records, err := openJournal(dir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the journal in %v, err: %w", dir, err)
+	}
+	j := makeJob(*records[0].Job, workers)
+	if abs, err := filepath.Abs(dir); err != nil || abs != jobDir(j.id) {
+		journal.file.Close()
+		return nil, fmt.Errorf("the job %s must be resumed from %v", j.id, jobDir(j.id))
+	}
+	j.journal = journal
+	j.replay(records)
+	//a failed job runs no further tasks, their outputs are not needed
+	if j.failure() == nil {
+		j.verifyOutputs()
+	}
+	//the plugin of a job which ended was removed, see ended
+	if !j.done() && j.pluginHash != "" {
+		j.plugin, err = ioutil.ReadFile(filepath.Join(dir, jobPluginFileName))
+		if err == nil && pluginHash(j.plugin) != j.pluginHash {
+			err = fmt.Errorf("the plugin does not match its hash %s", j.pluginHash)
+		}
+		if err != nil {
+			journal.file.Close()
+			return nil, fmt.Errorf("unable to read the plugin of the job %s, err: %w", j.id, err)
+		}
+	}
+	if j.failure() != nil {
+		j.ended()
+	}
+	log.Printf(
+		"Resumed the job %s from %v, completed %d of %d map and %d of %d reduce tasks", j.id, dir,
+		j.completedTasks(MapPhase), j.numMap, j.completedTasks(ReducePhase), j.numReduce,
+	)
+	return j, nil
+}
+
+/**
+Sets the input format of a job without one to the InputFormat of its plugin. The plugin is
+opened by the submitter, the controller does not run the code of a submitted plugin unless it
+samples the range partitioner.
+*/
+func resolveInputFormat(config *JobConfig) error {
+	if config.InputFormat != "" || len(config.Plugin) == 0 {
+		return nil
+	}
+	plugin, err := openPlugin(config.Plugin)
+	if err != nil {
+		return err
+	}
+	config.InputFormat = plugin.InputFormat
+	return nil
+}
+
+func makeJob(spec journalJob, workers *workerRegistry) *job {
+	j := job{}
+	j.id = spec.Uuid
+	j.submitted = spec.Submitted
+	j.pluginHash = spec.PluginHash
+	j.inputFormat = spec.InputFormat
+	j.outputFormat = spec.OutputFormat
+	j.outputCodec = spec.OutputCodec
+	j.noSort = spec.NoSort
+	//journals without the format get the default, the readers detect the format of earlier map outputs
+	j.intermediate, _ = newKVFormat(spec.IntermediateFormat, spec.IntermediateCodec)
+	j.partitioner = spec.Partitioner
+	j.rangeBoundaries = spec.RangeBoundaries
+	j.mapTimeout = newTaskTimeout(spec.MapTimeout, spec.AdaptiveTimeout)
+	j.reduceTimeout = newTaskTimeout(spec.ReduceTimeout, spec.AdaptiveTimeout)
+	j.numMap = len(spec.Splits)
+	j.numReduce = spec.NumReduce
+	j.mapTasks = make(map[int]*task)
+	j.reduceTasks = make(map[int]*task)
+	j.workers = workers
+	j.maxAttempts = spec.MaxAttempts
+	j.failurePolicy = spec.FailurePolicy
+	j.speculative = spec.Speculative
+	j.mapTasksCompleted = false
+	j.reduceTasksCompleted = false
+
+	for i := 0; i < j.numMap; i++ {
+		j.mapTasks[i] = &task{
+			split: spec.Splits[i],
+			state: Unassigned,
+		}
+	}
+
+	for i := 0; i < j.numReduce; i++ {
+		j.reduceTasks[i] = &task{
+			state: Unassigned,
+		}
+	}
+	return &j
+}
+
+/**
+Helper functions
+*/
+
+/*
+Check for all the Map tasks completion.
+*/
+func (j *job) isMapTaskCompleted() bool {
+	j.mx.Lock()
+	completed, lost := j.mapTasksCompleted, j.mapOutputsLost
+	j.mx.Unlock()
+	if completed == true {
+		return true
+	}
+	for _, t := range j.mapTasks {
+		t.mx.Lock()
+		if t.state != Completed {
+			t.mx.Unlock()
+			return false
+		}
+		t.mx.Unlock()
+	}
+	j.mx.Lock()
+	defer j.mx.Unlock()
+	//a map output lost while the tasks were checked may have been counted as completed
+	if j.mapOutputsLost == lost {
+		j.mapTasksCompleted = true
+	}
+	return j.mapTasksCompleted
+}
+
+/**
+Returns the accepted attempt of every map task and the shuffle server it is served from, the
+reducers fetch the output of these attempts.
+*/
+func (j *job) acceptedMapOutputs() ([]int, []string) {
+	attempts := make([]int, j.numMap)
+	locations := make([]string, j.numMap)
+	for i := 0; i < j.numMap; i++ {
+		t := j.mapTasks[i]
+		t.mx.Lock()
+		attempts[i] = t.accepted
+		locations[i] = t.location
+		t.mx.Unlock()
+	}
+	return attempts, locations
+}
+
+func (j *job) assignMapTask(workerId string) (int, int) {
+	return j.assignTask(MapPhase, workerId)
+}
+
+/*
+Check for all the Reduce tasks completion.
+*/
+func (j *job) isReduceTaskCompleted() bool {
+	j.mx.Lock()
+	completed := j.reduceTasksCompleted
+	j.mx.Unlock()
+	if completed == true {
+		return true
+	}
+	for _, t := range j.reduceTasks {
+		t.mx.Lock()
+		if t.state != Completed {
+			t.mx.Unlock()
+			return false
+		}
+		t.mx.Unlock()
+	}
+	j.mx.Lock()
+	completed = j.reduceTasksCompleted
+	j.reduceTasksCompleted = true
+	j.mx.Unlock()
+	if !completed {
+		log.Printf("Job %s completed, output in %v", j.id, jobOutputDir(j.id))
+		j.ended()
+	}
+	return true
+}
+
+func (j *job) assignReduceTask(workerId string) (int, int) {
+	return j.assignTask(ReducePhase, workerId)
+}
+
+func (j *job) tasks(phase string) map[int]*task {
+	if phase == MapPhase {
+		return j.mapTasks
+	}
+	return j.reduceTasks
+}
+
+func (j *job) timeout(phase string) *taskTimeout {
+	if phase == MapPhase {
+		return j.mapTimeout
+	}
+	return j.reduceTimeout
+}
+
+/**
+Assigns a task of the phase to the worker: an unassigned task, a task whose attempts all timed
+out, or else a backup attempt of a straggler. Returns the task id and the attempt number, the
+task id is -1 if there is nothing to do.
+*/
+func (j *job) assignTask(phase string, workerId string) (int, int) {
+	lease := j.timeout(phase).lease()
+	for i, t := range j.tasks(phase) {
+		t.mx.Lock()
+		if t.state == Assigned {
+			expired := t.expire(lease)
+			for _, a := range expired {
+				log.Printf(
+					"Assigning %s task %d attempt %d of job %s timed out after %v on %s \n", phase, i, a.number, j.id,
+					lease, a.workerId,
+				)
+				j.workers.assignTask(phase, a.workerId, TaskRef{JobId: j.id, TaskId: i}, false)
+			}
+			if len(t.running()) == 0 {
+				j.retryOrGiveUp(phase, i, t)
+			}
+			if len(expired) > 0 {
+				j.journalTask(phase, i, t)
+			}
+		}
+		if t.state != Unassigned || j.failure() != nil {
+			t.mx.Unlock()
+			continue
+		}
+		attempt := t.assignTask(workerId)
+		j.journalTask(phase, i, t)
+		j.workers.assignTask(phase, workerId, TaskRef{JobId: j.id, TaskId: i}, true)
+		log.Printf("Assigning %s Task %d attempt %d of job %s to the worker %s", phase, i, attempt, j.id, workerId)
+		t.mx.Unlock()
+		return i, attempt
+	}
+	if j.speculative && j.failure() == nil {
+		return j.speculate(phase, workerId)
+	}
+	return -1, 0
+}
+
+/**
+Completes the task with the output of the attempt. The other running attempts lose, their
+output is rejected when they report. The task lock is held by the caller.
+*/
+func (j *job) completeTask(phase string, taskId int, t *task, a *taskAttempt) {
+	t.state = Completed
+	t.accepted = a.number
+	a.finish(attemptSucceeded, "")
+	ref := TaskRef{JobId: j.id, TaskId: taskId}
+	j.workers.assignTask(phase, a.workerId, ref, false)
+	for _, other := range t.running() {
+		other.finish(attemptKilled, fmt.Sprintf("attempt %d completed first", a.number))
+		j.workers.assignTask(phase, other.workerId, ref, false)
+	}
+	j.journalTask(phase, taskId, t)
+	j.timeout(phase).record(a.end.Sub(a.start))
+}
+
+/**
+Ends the running attempts of the worker, e.g. because it stopped.
+*/
+func (j *job) release(phase string, taskId int, workerId string, reason string) {
+	t, ok := j.tasks(phase)[taskId]
+	if !ok {
+		return
+	}
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	released := false
+	for _, a := range t.running() {
+		if a.workerId == workerId {
+			log.Printf("Releasing %s task %d attempt %d of job %s of %s", phase, taskId, a.number, j.id, workerId)
+			a.finish(attemptReleased, reason)
+			released = true
+		}
+	}
+	if t.state == Assigned && len(t.running()) == 0 {
+		t.state = Unassigned
+	}
+	if released {
+		j.journalTask(phase, taskId, t)
+	}
+}
+
+/**
+Extends the leases of the running attempts of the task on the worker.
+*/
+func (j *job) renew(phase string, taskId int, workerId string) {
+	if t, ok := j.tasks(phase)[taskId]; ok {
+		t.mx.Lock()
+		t.renew(workerId)
+		t.mx.Unlock()
+	}
+}
+
+/**
+Number of completed tasks of the phase.
+*/
+func (j *job) completedTasks(phase string) int {
+	completed := 0
+	for _, t := range j.tasks(phase) {
+		t.mx.Lock()
+		if t.state == Completed {
+			completed++
+		}
+		t.mx.Unlock()
+	}
+	return completed
+}
+
+/**
+Returns host:path of the output file of each completed reduce task, the host of the shuffle
+server of its reducer. "" for the tasks which did not complete or were skipped.
+*/
+func (j *job) outputs() []string {
+	outputs := make([]string, j.numReduce)
+	for i := 0; i < j.numReduce; i++ {
+		t := j.reduceTasks[i]
+		t.mx.Lock()
+		if t.state == Completed && !t.skipped {
+			host, _, err := net.SplitHostPort(t.location)
+			if err != nil {
+				host = t.location
+			}
+			outputs[i] = host + ":" + filepath.Join(jobOutputDir(j.id), reduceOutputName(i))
+		}
+		t.mx.Unlock()
+	}
+	return outputs
+}
+
+/**
+Reports the progress of the job.
+*/
+func (j *job) status() JobStatusResponse {
+	status := JobStatusResponse{
+		State:           JobRunning,
+		NumMap:          j.numMap,
+		MapCompleted:    j.completedTasks(MapPhase),
+		NumReduce:       j.numReduce,
+		ReduceCompleted: j.completedTasks(ReducePhase),
+		OutputDir:       jobOutputDir(j.id),
+		Outputs:         j.outputs(),
+		FailureSummary:  j.failureSummary(),
+	}
+	if err := j.failure(); err != nil {
+		status.State = JobFailed
+		status.Error = err.Error()
+	} else if j.done() {
+		status.State = JobCompleted
+	}
+	return status
+}
+
+/**
+Removes the files of the job on the controller which are no longer needed once it ended: the
+copy of its plugin and the map outputs on this host. The workers remove their map outputs once
+the heartbeat tells them the job ended, the journal and the reduce outputs are kept.
+*/
+func (j *job) ended() {
+	j.cleanup.Do(func() {
+		if j.pluginHash != "" {
+			os.Remove(filepath.Join(jobDir(j.id), jobPluginFileName))
+		}
+		os.RemoveAll(jobMapDir(j.id))
+	})
+}
+
+/**
+Checks if the job ended, i.e. completed or failed.
+*/
+func (j *job) done() bool {
+	if j.failure() != nil {
+		return true
+	}
+	return j.isMapTaskCompleted() && j.isReduceTaskCompleted()
+}
@@ -0,0 +1,292 @@
+package distributed
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"gomr.com/gomr/input"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const journalFileName = "journal.jsonl"
+
+/**
+Everything needed to rebuild the tasks of a job, written as the first record of the journal.
+*/
+type journalJob struct {
+	Uuid               string
+	Submitted          time.Time //orders the jobs resumed together, see Controller.ResumeAll
+	PluginHash         string    //the plugin is kept in the job directory, see jobPluginFileName
+	InputFormat        string
+	OutputFormat       string
+	OutputCodec        string `json:",omitempty"`
+	NoSort             bool
+	IntermediateFormat string `json:",omitempty"` //intermediate format of the map outputs
+	IntermediateCodec  string `json:",omitempty"`
+	Partitioner        string
+	RangeBoundaries    []string
+	Splits             []input.Split
+	NumReduce          int
+	MapTimeout         time.Duration
+	ReduceTimeout      time.Duration
+	AdaptiveTimeout    bool
+	MaxAttempts        int
+	FailurePolicy      string
+	Speculative        bool
+}
+
+type journalAttempt struct {
+	Number   int
+	WorkerId string
+	Start    time.Time
+	End      time.Time
+	Status   attemptStatus
+	Error    string
+}
+
+/**
+Snapshot of a task after a state transition, the last snapshot of a task is its state.
+*/
+type journalTask struct {
+	Phase    string
+	TaskId   int
+	State    State
+	Attempt  int
+	Accepted int
+	Skipped  bool
+	Location string `json:",omitempty"`
+	Attempts []journalAttempt
+}
+
+/**
+A record of the journal, exactly one of its fields is set.
+*/
+type journalRecord struct {
+	Job    *journalJob  `json:",omitempty"`
+	Task   *journalTask `json:",omitempty"`
+	Worker int          `json:",omitempty"` //number of a registered worker, ids are not reused after a restart
+	Failed string       `json:",omitempty"` //why the job failed
+}
+
+/**
+Write-ahead journal of a job. Every state transition of a task is appended and synced
+to disk before the workers learn about it, so a restarted controller can rebuild the state
+of the job from it.
+*/
+type journal struct {
+	mx   sync.Mutex
+	file *os.File
+}
+
+/**
+Creates the journal of a new job in dir.
+*/
+func createJournal(dir string) (*journal, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(filepath.Join(dir, journalFileName), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &journal{file: file}, nil
+}
+
+/**
+Reads the journal of the job in dir and opens it to append further records.
+*/
+func openJournal(dir string) (*journal, []journalRecord, error) {
+	path := filepath.Join(dir, journalFileName)
+	file, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	records := []journalRecord{}
+	reader := bufio.NewReader(file)
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				//the controller crashed while appending the last record
+				log.Printf("Ignoring the incomplete last record of the journal %v", path)
+			}
+			break
+		}
+		if err != nil {
+			file.Close()
+			return nil, nil, err
+		}
+		record := journalRecord{}
+		if err := json.Unmarshal(line, &record); err != nil {
+			file.Close()
+			return nil, nil, fmt.Errorf("corrupt record at offset %d of the journal %v, err: %w", offset, path, err)
+		}
+		records = append(records, record)
+		offset += int64(len(line))
+	}
+	if len(records) == 0 || records[0].Job == nil {
+		file.Close()
+		return nil, nil, fmt.Errorf("the journal %v does not start with a job", path)
+	}
+	//drop the incomplete record, the next one is appended after the last complete one
+	if err := file.Truncate(offset); err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	return &journal{file: file}, records, nil
+}
+
+/**
+Appends the record and syncs it to disk. The controller cannot continue without its journal,
+a failed write stops it.
+*/
+func (j *journal) append(record journalRecord) {
+	line, err := json.Marshal(record)
+	if err != nil {
+		log.Fatalf("Unable to encode the journal record, err: %v", err)
+	}
+	j.mx.Lock()
+	defer j.mx.Unlock()
+	if _, err := j.file.Write(append(line, '\n')); err != nil {
+		log.Fatalf("Unable to write the journal %v, err: %v", j.file.Name(), err)
+	}
+	if err := j.file.Sync(); err != nil {
+		log.Fatalf("Unable to sync the journal %v, err: %v", j.file.Name(), err)
+	}
+}
+
+func snapshotTask(phase string, taskId int, t *task) *journalTask {
+	snapshot := &journalTask{
+		Phase:    phase,
+		TaskId:   taskId,
+		State:    t.state,
+		Attempt:  t.attempt,
+		Accepted: t.accepted,
+		Skipped:  t.skipped,
+		Location: t.location,
+	}
+	for _, a := range t.attempts {
+		snapshot.Attempts = append(snapshot.Attempts, journalAttempt{
+			Number:   a.number,
+			WorkerId: a.workerId,
+			Start:    a.start,
+			End:      a.end,
+			Status:   a.status,
+			Error:    a.err,
+		})
+	}
+	return snapshot
+}
+
+/**
+Restores the task from its snapshot. The leases of the running attempts start over, their
+workers keep them alive with heartbeats once they registered again.
+*/
+func (t *task) restore(snapshot *journalTask) {
+	t.state = snapshot.State
+	t.attempt = snapshot.Attempt
+	t.accepted = snapshot.Accepted
+	t.skipped = snapshot.Skipped
+	t.location = snapshot.Location
+	t.attempts = nil
+	now := time.Now()
+	for _, a := range snapshot.Attempts {
+		t.attempts = append(t.attempts, &taskAttempt{
+			number:    a.Number,
+			workerId:  a.WorkerId,
+			start:     a.Start,
+			renewTime: now,
+			end:       a.End,
+			status:    a.Status,
+			err:       a.Error,
+		})
+	}
+}
+
+/**
+Journals the state of the task, the task lock is held by the caller.
+*/
+func (j *job) journalTask(phase string, taskId int, t *task) {
+	j.journal.append(journalRecord{Task: snapshotTask(phase, taskId, t)})
+}
+
+/**
+Rebuilds the state of the job from the records of its journal.
+*/
+func (j *job) replay(records []journalRecord) {
+	for _, record := range records[1:] {
+		switch {
+		case record.Task != nil:
+			tasks := j.mapTasks
+			if record.Task.Phase == ReducePhase {
+				tasks = j.reduceTasks
+			}
+			if t, ok := tasks[record.Task.TaskId]; ok {
+				t.restore(record.Task)
+			}
+		case record.Worker != 0:
+			j.workers.reserve(record.Worker)
+		case record.Failed != "":
+			j.err = fmt.Errorf("%s", record.Failed)
+		}
+	}
+	//the durations of the completed tasks feed the speculation
+	recordDurations := func(tasks map[int]*task, timeout *taskTimeout) {
+		for _, t := range tasks {
+			for _, a := range t.attempts {
+				if a.status == attemptSucceeded {
+					timeout.record(a.end.Sub(a.start))
+				}
+			}
+		}
+	}
+	recordDurations(j.mapTasks, j.mapTimeout)
+	recordDurations(j.reduceTasks, j.reduceTimeout)
+}
+
+/**
+Hands out the completed tasks again whose output is no longer on disk, or for a map task no
+longer served by the shuffle server of its worker. The map outputs are only needed while
+reduce tasks are left.
+*/
+func (j *job) verifyOutputs() {
+	reduceLeft := false
+	for i, t := range j.reduceTasks {
+		if t.state == Completed && !t.skipped {
+			//the output is on the host of the reducer, which may share the filesystem of the controller
+			_, err := os.Stat(filepath.Join(jobOutputDir(j.id), reduceOutputName(i)))
+			if err != nil && (t.location == "" || !outputAvailable(reduceOutputURL(t.location, j.id, i))) {
+				log.Printf("The output of reduce task %d is missing, running it again", i)
+				t.state = Unassigned
+				j.journalTask(ReducePhase, i, t)
+			}
+		}
+		if t.state != Completed {
+			reduceLeft = true
+		}
+	}
+	if !reduceLeft {
+		return
+	}
+	for i, t := range j.mapTasks {
+		if t.state != Completed || t.skipped {
+			continue
+		}
+		for r := 0; r < j.numReduce; r++ {
+			if !outputAvailable(mapOutputURL(t.location, j.id, i, r, t.accepted)) {
+				j.loseMapOutput(i, t, "it is no longer served by its worker")
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package distributed
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+/**
+Writes the records as the journal in dir, followed by the incomplete record torn.
+*/
+func writeTestJournal(t *testing.T, dir string, records []journalRecord, torn string) {
+	t.Helper()
+	var content strings.Builder
+	for _, record := range records {
+		line, err := json.Marshal(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		content.Write(line)
+		content.WriteString("\n")
+	}
+	content.WriteString(torn)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, journalFileName), []byte(content.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readTestJournal(t *testing.T, dir string) []journalRecord {
+	t.Helper()
+	j, records, err := openJournal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.file.Close()
+	return records
+}
+
+func TestOpenJournalIgnoresTornRecord(t *testing.T) {
+	quietLog(t)
+	dir := t.TempDir()
+	spec := testJobSpec(2, 1, 1)
+	task := journalRecord{Task: &journalTask{Phase: MapPhase, TaskId: 0, State: Assigned, Attempt: 1}}
+	writeTestJournal(t, dir, []journalRecord{{Job: &spec}, task}, `{"Task":{"Phase":"map","Tas`)
+
+	j, records, err := openJournal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].Job.Uuid != spec.Uuid || records[1].Task.State != Assigned {
+		t.Fatalf("read %d records: %+v", len(records), records)
+	}
+	//the next record replaces the torn one
+	j.append(journalRecord{Worker: 3})
+	j.file.Close()
+	records = readTestJournal(t, dir)
+	if len(records) != 3 || records[2].Worker != 3 {
+		t.Fatalf("read %d records after appending: %+v", len(records), records)
+	}
+}
+
+func TestOpenJournalRejectsCorruptRecords(t *testing.T) {
+	dir := t.TempDir()
+	spec := testJobSpec(1, 1, 1)
+	writeTestJournal(t, dir, []journalRecord{{Job: &spec}}, "garbage\n{}\n")
+	if _, _, err := openJournal(dir); err == nil {
+		t.Fatal("opened a journal with a corrupt record")
+	}
+	writeTestJournal(t, dir, []journalRecord{{Worker: 1}}, "")
+	if _, _, err := openJournal(dir); err == nil {
+		t.Fatal("opened a journal which does not start with a job")
+	}
+}
+
+func TestReplayRestoresTasks(t *testing.T) {
+	spec := testJobSpec(3, 1, 2)
+	start := time.Now().Add(-time.Minute)
+	attempt := func(number int, workerId string, status attemptStatus, runtime time.Duration) journalAttempt {
+		a := journalAttempt{Number: number, WorkerId: workerId, Start: start, Status: status}
+		if status != attemptRunning {
+			a.End = start.Add(runtime)
+		}
+		return a
+	}
+	records := []journalRecord{
+		{Job: &spec},
+		{Worker: 1},
+		{Task: &journalTask{Phase: MapPhase, TaskId: 0, State: Assigned, Attempt: 1,
+			Attempts: []journalAttempt{attempt(1, "worker-1", attemptRunning, 0)}}},
+		{Worker: 4},
+		{Worker: 2},
+		//the last snapshot of a task is its state
+		{Task: &journalTask{Phase: MapPhase, TaskId: 0, State: Completed, Attempt: 1, Accepted: 1, Location: "host:1",
+			Attempts: []journalAttempt{attempt(1, "worker-1", attemptSucceeded, 4*time.Second)}}},
+		{Task: &journalTask{Phase: MapPhase, TaskId: 1, State: Assigned, Attempt: 2,
+			Attempts: []journalAttempt{
+				attempt(1, "worker-2", attemptFailed, time.Second), attempt(2, "worker-4", attemptRunning, 0),
+			}}},
+		{Task: &journalTask{Phase: ReducePhase, TaskId: 0, State: Completed, Attempt: 1, Accepted: 1, Skipped: true,
+			Attempts: []journalAttempt{attempt(1, "worker-4", attemptFailed, time.Second)}}},
+		//snapshots of tasks the job does not have are ignored
+		{Task: &journalTask{Phase: ReducePhase, TaskId: 7, State: Completed}},
+	}
+	j := makeJob(spec, newWorkerRegistry())
+	j.replay(records)
+
+	tests := []struct {
+		phase    string
+		taskId   int
+		state    State
+		accepted int
+		skipped  bool
+		location string
+		attempts int
+		running  int
+	}{
+		{MapPhase, 0, Completed, 1, false, "host:1", 1, 0},
+		{MapPhase, 1, Assigned, 0, false, "", 2, 1},
+		{MapPhase, 2, Unassigned, 0, false, "", 0, 0},
+		{ReducePhase, 0, Completed, 1, true, "", 1, 0},
+	}
+	for _, test := range tests {
+		task := j.tasks(test.phase)[test.taskId]
+		if task.state != test.state || task.accepted != test.accepted || task.skipped != test.skipped ||
+			task.location != test.location || len(task.attempts) != test.attempts || len(task.running()) != test.running {
+			t.Errorf(
+				"%s task %d: state %v, accepted %d, skipped %v, location %q, %d attempts, %d running", test.phase,
+				test.taskId, task.state, task.accepted, task.skipped, task.location, len(task.attempts), len(task.running()),
+			)
+		}
+	}
+	//the running attempt keeps its start but gets a fresh lease
+	running := j.mapTasks[1].running()[0]
+	if !running.start.Equal(start) || time.Since(running.renewTime) > time.Minute/2 {
+		t.Errorf("the running attempt started at %v, its lease at %v", running.start, running.renewTime)
+	}
+	if median, ok := j.mapTimeout.median(); !ok || median != 4*time.Second {
+		t.Errorf("the completed map task recorded %v %v", median, ok)
+	}
+	if _, ok := j.reduceTimeout.median(); ok {
+		t.Errorf("the skipped reduce task recorded a duration")
+	}
+	if err := j.failure(); err != nil {
+		t.Errorf("the job failed: %v", err)
+	}
+
+	//the numbers of the workers registered before the restart are not handed out again
+	if last := j.workers.lastNumber(); last != 4 {
+		t.Errorf("the last worker number is %d, expected 4", last)
+	}
+	if id, _ := j.workers.register("localhost", 1, 1); id != "worker-5" {
+		t.Errorf("registered %s after the restart, expected worker-5", id)
+	}
+}
+
+func TestReplayFailedJob(t *testing.T) {
+	spec := testJobSpec(1, 1, 1)
+	records := []journalRecord{
+		{Job: &spec},
+		{Task: &journalTask{Phase: MapPhase, TaskId: 0, State: Completed, Attempt: 1, Accepted: 1, Skipped: true}},
+		{Failed: "map task 0 failed 1 times"},
+	}
+	j := makeJob(spec, newWorkerRegistry())
+	j.replay(records)
+	if err := j.failure(); err == nil || err.Error() != "map task 0 failed 1 times" {
+		t.Fatalf("the replayed job failed with %v", err)
+	}
+	if !j.done() {
+		t.Fatal("the failed job is not done")
+	}
+}
+
+func TestResumeJob(t *testing.T) {
+	quietLog(t)
+	spec := testJobSpec(1, 1, 1)
+	dir := jobDir(spec.Uuid)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	records := []journalRecord{{Job: &spec}, {Worker: 2}, {Failed: "reduce task 0 failed 1 times"}}
+	writeTestJournal(t, dir, records, `{"Work`)
+
+	if _, err := resumeJob(t.TempDir(), newWorkerRegistry()); err == nil {
+		t.Fatal("resumed a job from a directory without a journal")
+	}
+	other := t.TempDir()
+	writeTestJournal(t, other, records, "")
+	if _, err := resumeJob(other, newWorkerRegistry()); err == nil {
+		t.Fatalf("resumed the job %s outside of %v", spec.Uuid, dir)
+	}
+
+	workers := newWorkerRegistry()
+	j, err := resumeJob(dir, workers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.journal.file.Close()
+	if j.id != spec.Uuid || j.failure() == nil || !j.done() || workers.lastNumber() != 2 {
+		t.Fatalf("resumed the job %s, failure: %v, last worker %d", j.id, j.failure(), workers.lastNumber())
+	}
+}
+
+func TestVerifyOutputsRequeuesMissingOutputs(t *testing.T) {
+	quietLog(t)
+	served := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer served.Close()
+	gone := httptest.NewServer(http.NotFoundHandler())
+	defer gone.Close()
+	location := func(server *httptest.Server) string {
+		return strings.TrimPrefix(server.URL, "http://")
+	}
+	completed := func(t *task, location string) {
+		t.state = Completed
+		t.attempt = 1
+		t.accepted = 1
+		t.location = location
+		t.attempts = []*taskAttempt{{number: 1, workerId: "worker-1", status: attemptSucceeded}}
+	}
+
+	c := newTestController()
+	j := newTestJob(t, c, testJobSpec(3, 3, 1))
+	completed(j.mapTasks[0], location(served))
+	completed(j.mapTasks[1], location(gone))
+	j.mapTasks[2].state = Completed
+	j.mapTasks[2].skipped = true
+	completed(j.reduceTasks[0], location(served))
+	completed(j.reduceTasks[1], "")
+	completed(j.reduceTasks[2], location(gone))
+	j.verifyOutputs()
+
+	tests := []struct {
+		phase  string
+		taskId int
+		state  State
+	}{
+		{MapPhase, 0, Completed},
+		{MapPhase, 1, Unassigned}, //no longer served
+		{MapPhase, 2, Completed},  //skipped, it has no output
+		{ReducePhase, 0, Completed},
+		{ReducePhase, 1, Unassigned}, //neither on disk nor served
+		{ReducePhase, 2, Unassigned},
+	}
+	for _, test := range tests {
+		if state := j.tasks(test.phase)[test.taskId].state; state != test.state {
+			t.Errorf("%s task %d is %v, expected %v", test.phase, test.taskId, state, test.state)
+		}
+	}
+	if status := j.mapTasks[1].attempts[0].status; status != attemptLost {
+		t.Errorf("the attempt of the lost map output is %v", status)
+	}
+
+	//the journal records the tasks handed out again
+	records := readTestJournal(t, filepath.Dir(j.journal.file.Name()))
+	requeued := map[string]bool{}
+	for _, record := range records[1:] {
+		if record.Task != nil && record.Task.State == Unassigned {
+			requeued[fmt.Sprintf("%s-%d", record.Task.Phase, record.Task.TaskId)] = true
+		}
+	}
+	if len(requeued) != 3 || !requeued["map-1"] || !requeued["reduce-1"] || !requeued["reduce-2"] {
+		t.Errorf("journaled the tasks %v as handed out again", requeued)
+	}
+}
+
+func TestVerifyOutputsKeepsMapOutputsOfCompletedJob(t *testing.T) {
+	quietLog(t)
+	gone := httptest.NewServer(http.NotFoundHandler())
+	defer gone.Close()
+	c := newTestController()
+	j := newTestJob(t, c, testJobSpec(1, 1, 1))
+	j.mapTasks[0].state = Completed
+	j.mapTasks[0].location = strings.TrimPrefix(gone.URL, "http://")
+	//a skipped reduce task has no output to verify, no reduce task is left
+	j.reduceTasks[0].state = Completed
+	j.reduceTasks[0].skipped = true
+	j.verifyOutputs()
+	if j.mapTasks[0].state != Completed {
+		t.Fatal("the map output was lost although no reduce task needs it")
+	}
+}
@@ -6,7 +6,7 @@ Workers to query if the Map/Reduce tasks are available
  */
 
 type CheckForMapTasksCompletionRequest struct {
-
+	JobId string //"" for all the jobs of the controller
 }
 
 type CheckForMapTasksCompletionResponse struct {
@@ -14,7 +14,7 @@ type CheckForMapTasksCompletionResponse struct {
 }
 
 type CheckForReduceTasksCompletionRequest struct {
-
+	JobId string //"" for all the jobs of the controller
 }
 
 type CheckForReducdTasksCompletionResponse struct {
@@ -22,26 +22,115 @@ type CheckForReducdTasksCompletionResponse struct {
 }
 
 
+/**
+Job submission, the controller hands out a job id which scopes the tasks and the directories of the job
+ */
+
+type SubmitJobRequest struct {
+	Inputs []string //input files, directories or globs
+	Job JobConfig
+}
+
+type SubmitJobResponse struct {
+	JobId string
+}
+
+type JobStatusRequest struct {
+	JobId string
+}
+
+type JobStatusResponse struct {
+	State string //JobRunning, JobCompleted or JobFailed
+	NumMap int
+	MapCompleted int
+	NumReduce int
+	ReduceCompleted int
+	OutputDir string //directory of the mr-out-<reduce> files of the job on the hosts of the reducers
+	Outputs []string //host:path of the output file of each completed reduce task, "" for the others
+	Error string //why the job failed
+	FailureSummary string //the tasks with failed attempts and their history
+}
+
+/**
+Plugin API, the workers fetch the plugin of a job from the controller and cache it by its hash
+ */
+
+type GetPluginRequest struct {
+	JobId string
+}
+
+type GetPluginResponse struct {
+	Hash string //hex encoded sha256 of the plugin
+	Plugin []byte //the plugin .so file
+}
+
+/**
+A task of a job
+ */
+type TaskRef struct {
+	JobId string
+	TaskId int
+}
+
+
+/**
+Worker registration, the controller hands out a worker id which identifies the worker in the other APIs
+ */
+
+type RegisterWorkerRequest struct {
+	Host string
+	Pid int
+	Capacity int //number of tasks the worker runs at once
+}
+
+type RegisterWorkerResponse struct {
+	WorkerId string
+}
+
+type DeregisterWorkerRequest struct {
+	WorkerId string
+}
+
+type DeregisterWorkerResponse struct {
+
+}
+
+
 /**
 Maps Related APIs
  */
 
 type GetMapTaskRequest struct{
-
+	WorkerId string
 }
 
 type GetMapTaskResponse struct {
+	JobId string
+	PluginHash string //plugin of the job, see GetPlugin, "" for the plugin the worker was started with
 	Filename string
+	Offset int64 //byte range of the file processed by the task
+	Length int64
+	InputFormat string //name of the input format reading the split
 	TaskId int //negative if no tasks available
+	Attempt int //attempt number of this assignment, the output files are scoped by it
 	NumReduce int
+	NoSort bool //partitions are written unsorted
+	IntermediateFormat string //format the partitions are written in, see IntermediateFormatNames
+	IntermediateCodec string //codec compressing the partitions, see codec.Lookup
+	Partitioner string //see partitionFunc
+	RangeBoundaries []string //boundaries of the range partitioner
 }
 
 type UpdateMapTaskRequest struct {
+	WorkerId string
+	JobId string
 	TaskId int
+	Attempt int
+	ShuffleAddr string //host:port of the shuffle server of the worker serving the output of the attempt
 }
 
 type UpdateMapTaskResponse struct {
-
+	Accepted bool //false for a stale attempt, the worker then removes its output
 }
 
 
@@ -50,18 +139,94 @@ Reduce Related APIs
 */
 
 type GetReduceTaskRequest struct{
-
+	WorkerId string
 }
 
 type GetReduceTaskResponse struct {
-	Filename string
+	JobId string
+	PluginHash string //plugin of the job, see GetPlugin, "" for the plugin the worker was started with
 	TaskId int //negative if no tasks available
+	Attempt int //attempt number of this assignment
+	NumMap int //number of map tasks
+	MapAttempts []int //accepted attempt of each map task, the reducer reads mr-(0..NumMap-1)-TaskId-attempt
+	MapLocations []string //shuffle server of the accepted attempt of each map task
+	OutputFormat string //name of the output format, see output.Lookup
+	OutputCodec string //codec compressing the output file, see codec.Lookup
+	NoSort bool //the partition is grouped in memory and written in no particular order
+	IntermediateFormat string //format of the merged runs the reducer writes, the map outputs are read in any format
+	IntermediateCodec string
+}
+
+type CanCommitReduceTaskRequest struct {
+	WorkerId string
+	JobId string
+	TaskId int
+	Attempt int
+}
+
+type CanCommitReduceTaskResponse struct {
+	Allowed bool //the worker publishes its output only if allowed, and discards it otherwise
 }
 
 type UpdateReduceTaskRequest struct {
+	WorkerId string
+	JobId string
 	TaskId int
+	Attempt int
+	ShuffleAddr string //host:port of the shuffle server of the worker, it also serves the output file of the attempt
 }
 
 type UpdateReduceTaskResponse struct {
+	Accepted bool //false for a stale attempt whose output was published after its lease expired
+}
 
-}
\ No newline at end of file
+/**
+Heartbeat API, renews the leases of the tasks held by the worker and tells it the jobs which ended
+*/
+
+type HeartbeatRequest struct {
+	WorkerId string
+	MapTasks []TaskRef
+	ReduceTasks []TaskRef
+}
+
+type HeartbeatResponse struct {
+	EndedJobs []string //jobs which ended, the worker removes their map outputs
+}
+
+
+/**
+Failure API, reports an attempt of a task which failed on the worker
+*/
+
+type ReportTaskFailureRequest struct {
+	WorkerId string
+	JobId string
+	Phase string //MapPhase or ReducePhase
+	TaskId int
+	Attempt int
+	Error string
+	Refused bool //the worker cannot run the tasks of the job, not a failed attempt
+}
+
+type ReportTaskFailureResponse struct {
+
+}
+
+/**
+Fetch failure API, reports a map output a reduce attempt could not fetch, the map task runs again
+*/
+
+type ReportFetchFailureRequest struct {
+	WorkerId string
+	JobId string
+	TaskId int //the reduce task
+	Attempt int
+	MapTaskId int
+	MapAttempt int
+	Error string
+}
+
+type ReportFetchFailureResponse struct {
+
+}
@@ -0,0 +1,174 @@
+package distributed
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"gomr.com/gomr/utils"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/**
+Directory of the plugins fetched from the controller, one file per content hash.
+*/
+const pluginsDirName = "/tmp/gomr/plugins"
+
+/**
+Name of the copy of the plugin in the directory of its job, read again when the job is resumed.
+*/
+const jobPluginFileName = "plugin.so"
+
+/**
+Returned for a plugin which cannot be loaded because another build of it, with the same plugin
+path, was loaded by the process before: Go loads a plugin path only once per process. The worker
+refuses the tasks of the job, they are handed to the other workers.
+*/
+var errPluginConflict = errors.New("another build of the plugin is loaded by the worker")
+
+/**
+Returns the content hash of a plugin binary, the hex encoded sha256.
+*/
+func pluginHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func pluginCachePath(hash string) string {
+	return filepath.Join(pluginsDirName, hash+".so")
+}
+
+/**
+Returns the path of the cached plugin with the hash, "" if it is not cached or the cached file
+does not match its hash.
+*/
+func cachedPlugin(hash string) string {
+	path := pluginCachePath(hash)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	if pluginHash(data) != hash {
+		log.Printf("The cached plugin %v does not match its hash, fetching it again", path)
+		return ""
+	}
+	return path
+}
+
+/**
+Writes the plugin to the cache and returns its path. The plugin is written to a temporary file
+first, the processes sharing the cache never open a partial plugin.
+*/
+func cachePlugin(data []byte, hash string) (string, error) {
+	if err := os.MkdirAll(pluginsDirName, os.ModePerm); err != nil {
+		return "", err
+	}
+	file, err := ioutil.TempFile(pluginsDirName, hash+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), pluginCachePath(hash))
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return pluginCachePath(hash), nil
+}
+
+/**
+Opens the plugin binary, through the cache: plugin.Open refuses a second copy of an already
+loaded plugin under another path, the copies of a plugin share their cache file.
+*/
+func openPlugin(data []byte) (*utils.Plugin, error) {
+	hash := pluginHash(data)
+	path := cachedPlugin(hash)
+	if path == "" {
+		var err error
+		if path, err = cachePlugin(data, hash); err != nil {
+			return nil, fmt.Errorf("cannot cache the plugin, err: %w", err)
+		}
+	}
+	return utils.OpenPlugin(path)
+}
+
+func (c *Controller) GetPlugin(request *GetPluginRequest, response *GetPluginResponse) error {
+	log.Printf("Handling request for the plugin of job %s", request.JobId)
+	j, err := c.job(request.JobId)
+	if err != nil {
+		return err
+	}
+	if j.pluginHash == "" {
+		return fmt.Errorf("the job %s has no plugin", j.id)
+	}
+	response.Hash = j.pluginHash
+	response.Plugin = j.plugin
+	return nil
+}
+
+func (w *worker) getPlugin(jobId string) (GetPluginResponse, error) {
+	log.Printf("Calling Controller.GetPlugin")
+	request := GetPluginRequest{JobId: jobId}
+	response := GetPluginResponse{}
+	if err := w.client.call("Controller.GetPlugin", &request, &response); err != nil {
+		return response, err
+	}
+	log.Printf("Got the plugin %s of job %s, %d bytes", response.Hash, jobId, len(response.Plugin))
+	return response, nil
+}
+
+/**
+Returns the plugin with the hash for a task of the job, the worker's own plugin if the job has
+none or ships the same one. A plugin which is not cached yet is fetched from the controller. The
+worker refuses the task if the plugin it got does not match the hash the task was handed out
+with, or if another build of it is loaded, see errPluginConflict.
+*/
+func (w *worker) loadPlugin(jobId string, hash string) (*utils.Plugin, error) {
+	if hash == "" {
+		if w.plugin == nil {
+			return nil, fmt.Errorf("the job %s has no plugin and the worker was started without one", jobId)
+		}
+		return w.plugin, nil
+	}
+	if hash == w.pluginHash && w.plugin != nil {
+		return w.plugin, nil
+	}
+	if plugin, ok := w.plugins[hash]; ok {
+		return plugin, nil
+	}
+	path := cachedPlugin(hash)
+	if path == "" {
+		response, err := w.getPlugin(jobId)
+		if err != nil {
+			return nil, err
+		}
+		if got := pluginHash(response.Plugin); got != hash || response.Hash != hash {
+			return nil, fmt.Errorf(
+				"refusing the task, the plugin of job %s has the hash %s, the task was handed out for %s", jobId,
+				got, hash,
+			)
+		}
+		if path, err = cachePlugin(response.Plugin, hash); err != nil {
+			return nil, fmt.Errorf("cannot cache the plugin of job %s, err: %w", jobId, err)
+		}
+	}
+	plugin, err := utils.OpenPlugin(path)
+	if err != nil && strings.Contains(err.Error(), "plugin already loaded") {
+		return nil, fmt.Errorf("%w: refusing the tasks of job %s, err: %v", errPluginConflict, jobId, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Loaded the plugin %v", path)
+	w.plugins[hash] = plugin
+	return plugin, nil
+}
@@ -0,0 +1,236 @@
+package distributed
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+/**
+Error message of the RPCs called with a worker id the controller does not know, e.g. after
+the controller restarted. The worker registers again on this error.
+*/
+const errUnknownWorkerMessage = "gomr: unknown worker"
+
+/**
+What the controller knows about a registered worker.
+*/
+type workerInfo struct {
+	id            string
+	host          string
+	pid           int
+	capacity      int //number of tasks the worker runs at once
+	registered    time.Time
+	lastHeartbeat time.Time
+	mapTasks      map[TaskRef]bool //tasks currently assigned to the worker
+	reduceTasks   map[TaskRef]bool
+	mapJobs       map[string]bool //jobs the worker ran map tasks of, it may hold their map outputs
+	refusedJobs   map[string]bool //jobs the worker cannot run, it is not handed their tasks
+}
+
+/**
+Live registry of the workers known to the controller.
+*/
+type workerRegistry struct {
+	mx      sync.Mutex
+	nextId  int
+	workers map[string]*workerInfo
+}
+
+func newWorkerRegistry() *workerRegistry {
+	return &workerRegistry{workers: make(map[string]*workerInfo)}
+}
+
+/**
+Registers a worker, returns its id and number.
+*/
+func (r *workerRegistry) register(host string, pid int, capacity int) (string, int) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	r.nextId++
+	id := fmt.Sprintf("worker-%d", r.nextId)
+	now := time.Now()
+	r.workers[id] = &workerInfo{
+		id:            id,
+		host:          host,
+		pid:           pid,
+		capacity:      capacity,
+		registered:    now,
+		lastHeartbeat: now,
+		mapTasks:      make(map[TaskRef]bool),
+		reduceTasks:   make(map[TaskRef]bool),
+		mapJobs:       make(map[string]bool),
+		refusedJobs:   make(map[string]bool),
+	}
+	log.Printf("Registered %s, host: %s, pid: %d, capacity: %d", id, host, pid, capacity)
+	return id, r.nextId
+}
+
+/**
+Makes sure the worker number is not handed out again, e.g. to a worker registering after a
+restart of the controller.
+*/
+func (r *workerRegistry) reserve(number int) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	if number > r.nextId {
+		r.nextId = number
+	}
+}
+
+/**
+Returns the number of the last registered worker, 0 if none registered yet.
+*/
+func (r *workerRegistry) lastNumber() int {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	return r.nextId
+}
+
+/**
+Removes the worker and returns the tasks which were still assigned to it.
+*/
+func (r *workerRegistry) deregister(id string) ([]TaskRef, []TaskRef, bool) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	info, ok := r.workers[id]
+	if !ok {
+		return nil, nil, false
+	}
+	delete(r.workers, id)
+	log.Printf("Deregistered %s, host: %s, pid: %d", id, info.host, info.pid)
+	return sortedRefs(info.mapTasks), sortedRefs(info.reduceTasks), true
+}
+
+func (r *workerRegistry) known(id string) bool {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	_, ok := r.workers[id]
+	return ok
+}
+
+/**
+Returns the ids of the workers which did not send a heartbeat for timeout.
+*/
+func (r *workerRegistry) lapsed(timeout time.Duration) []string {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	ids := []string{}
+	for id, info := range r.workers {
+		if time.Since(info.lastHeartbeat) >= timeout {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (r *workerRegistry) heartbeat(id string) bool {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	info, ok := r.workers[id]
+	if ok {
+		info.lastHeartbeat = time.Now()
+	}
+	return ok
+}
+
+/**
+Records the assignment of a task of the phase to the worker, or its release if assigned is false.
+*/
+func (r *workerRegistry) assignTask(phase string, id string, ref TaskRef, assigned bool) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	info, ok := r.workers[id]
+	if !ok {
+		return
+	}
+	if phase == MapPhase {
+		setTask(info.mapTasks, ref, assigned)
+		if assigned {
+			info.mapJobs[ref.JobId] = true
+		}
+	} else {
+		setTask(info.reduceTasks, ref, assigned)
+	}
+}
+
+/**
+Returns the jobs the worker ran map tasks of which ended, and forgets them: the worker is told
+once to remove their map outputs. ended runs without the registry lock, it takes the task locks
+which are held while the registry is locked to assign a task.
+*/
+func (r *workerRegistry) endedJobs(id string, ended func(string) bool) []string {
+	r.mx.Lock()
+	info, ok := r.workers[id]
+	jobIds := []string{}
+	if ok {
+		for jobId := range info.mapJobs {
+			jobIds = append(jobIds, jobId)
+		}
+	}
+	r.mx.Unlock()
+
+	endedIds := []string{}
+	for _, jobId := range jobIds {
+		if ended(jobId) {
+			endedIds = append(endedIds, jobId)
+		}
+	}
+	if len(endedIds) == 0 {
+		return nil
+	}
+	r.mx.Lock()
+	for _, jobId := range endedIds {
+		delete(info.mapJobs, jobId)
+	}
+	r.mx.Unlock()
+	sort.Strings(endedIds)
+	return endedIds
+}
+
+/**
+Records that the worker cannot run the tasks of the job, e.g. because another build of its plugin
+is loaded in the worker.
+*/
+func (r *workerRegistry) refuseJob(id string, jobId string) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	if info, ok := r.workers[id]; ok {
+		info.refusedJobs[jobId] = true
+	}
+}
+
+/**
+Checks if the worker refused the tasks of the job.
+*/
+func (r *workerRegistry) refused(id string, jobId string) bool {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	info, ok := r.workers[id]
+	return ok && info.refusedJobs[jobId]
+}
+
+func setTask(tasks map[TaskRef]bool, ref TaskRef, assigned bool) {
+	if assigned {
+		tasks[ref] = true
+	} else {
+		delete(tasks, ref)
+	}
+}
+
+func sortedRefs(tasks map[TaskRef]bool) []TaskRef {
+	refs := []TaskRef{}
+	for ref := range tasks {
+		refs = append(refs, ref)
+	}
+	sort.Slice(refs, func(i, j int) bool {
+		if refs[i].JobId != refs[j].JobId {
+			return refs[i].JobId < refs[j].JobId
+		}
+		return refs[i].TaskId < refs[j].TaskId
+	})
+	return refs
+}
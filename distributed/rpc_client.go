@@ -0,0 +1,116 @@
+package distributed
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/rpc"
+	"time"
+)
+
+var (
+	// the controller could not be reached before the deadline
+	ErrControllerUnreachable = errors.New("controller unreachable")
+	// the controller has finished the job and has no more work
+	ErrJobDone = errors.New("controller finished the job")
+	// the controller does not know the worker id, the worker has to register again
+	ErrUnknownWorker = errors.New("worker not registered with the controller")
+)
+
+/**
+Error message returned by the Controller RPCs once the job is done. net/rpc only carries
+the error string to the client, so the client matches on it.
+*/
+const errJobDoneMessage = "gomr: job completed"
+
+const (
+	DefaultRPCDeadline = 30 * time.Second
+
+	initialRPCBackoff = 100 * time.Millisecond
+	maxRPCBackoff     = 5 * time.Second
+)
+
+/**
+RPC client used by the workers to talk to the Controller.
+
+Dial and connection errors are retried with exponential backoff and jitter until the
+deadline expires. Errors returned by the RPC handler itself are not retried.
+*/
+type rpcClient struct {
+	network  string
+	address  string
+	deadline time.Duration
+	random   *rand.Rand
+}
+
+func newRPCClient(addr string, deadline time.Duration) *rpcClient {
+	network, address := parseAddr(addr)
+	if deadline <= 0 {
+		deadline = DefaultRPCDeadline
+	}
+	return &rpcClient{
+		network:  network,
+		address:  address,
+		deadline: deadline,
+		random:   rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+/**
+Returns the sleep before the given retry attempt: exponential growth capped at
+maxRPCBackoff, with "full jitter" to spread the workers out after a controller restart.
+*/
+func (c *rpcClient) backoff(attempt int) time.Duration {
+	backoff := initialRPCBackoff << uint(attempt)
+	if backoff <= 0 || backoff > maxRPCBackoff {
+		backoff = maxRPCBackoff
+	}
+	return time.Duration(c.random.Int63n(int64(backoff))) + time.Millisecond
+}
+
+/**
+Calls the api on the Controller.
+
+returns:
+ 1. nil on success
+ 2. ErrJobDone if the controller reported the job as finished
+ 3. ErrUnknownWorker if the controller does not know the worker id of the request
+ 4. ErrControllerUnreachable (wrapped) if the deadline expired while retrying
+ 5. any other error returned by the RPC handler
+*/
+func (c *rpcClient) call(api string, request interface{}, response interface{}) error {
+	start := time.Now()
+	var lastErr error
+	for attempt := 0; ; attempt++ {
+		lastErr = c.callOnce(api, request, response)
+		if lastErr == nil {
+			return nil
+		}
+		if serverErr, ok := lastErr.(rpc.ServerError); ok {
+			if string(serverErr) == errJobDoneMessage {
+				return ErrJobDone
+			}
+			if string(serverErr) == errUnknownWorkerMessage {
+				return ErrUnknownWorker
+			}
+			return fmt.Errorf("%s failed: %w", api, lastErr)
+		}
+		sleep := c.backoff(attempt)
+		if time.Since(start)+sleep > c.deadline {
+			break
+		}
+		log.Printf("Calling %s failed, retrying in %v, err: %v", api, sleep, lastErr)
+		time.Sleep(sleep)
+	}
+	return fmt.Errorf("%w: %s %s after %v, err: %v", ErrControllerUnreachable, c.network, c.address, c.deadline, lastErr)
+}
+
+func (c *rpcClient) callOnce(api string, request interface{}, response interface{}) error {
+	client, err := rpc.DialHTTP(c.network, c.address)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	return client.Call(api, request, response)
+}
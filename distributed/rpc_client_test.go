@@ -0,0 +1,152 @@
+package distributed
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/rpc"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+/**
+Stands in for the Controller, returns the error named by the request.
+*/
+type testRPCService struct {
+	calls int32
+}
+
+func (s *testRPCService) Call(request *string, response *string) error {
+	atomic.AddInt32(&s.calls, 1)
+	switch *request {
+	case "done":
+		return errors.New(errJobDoneMessage)
+	case "unknown":
+		return errors.New(errUnknownWorkerMessage)
+	case "fail":
+		return errors.New("the handler failed")
+	}
+	*response = *request
+	return nil
+}
+
+/**
+Serves the service on the listener until the test ends.
+*/
+func serveTestRPC(t *testing.T, listener net.Listener) *testRPCService {
+	t.Helper()
+	service := &testRPCService{}
+	server := rpc.NewServer()
+	if err := server.RegisterName("Controller", service); err != nil {
+		t.Fatal(err)
+	}
+	httpServer := &http.Server{Handler: server}
+	go httpServer.Serve(listener)
+	t.Cleanup(func() { httpServer.Close() })
+	return service
+}
+
+func TestRPCErrorClassification(t *testing.T) {
+	quietLog(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := serveTestRPC(t, listener)
+	client := newRPCClient(listener.Addr().String(), 5*time.Second)
+
+	tests := []struct {
+		request string
+		err     error //the error errors.Is matches, nil for none
+		message string
+	}{
+		{"ok", nil, ""},
+		{"done", ErrJobDone, ErrJobDone.Error()},
+		{"unknown", ErrUnknownWorker, ErrUnknownWorker.Error()},
+		{"fail", nil, "Controller.Call failed: the handler failed"},
+	}
+	for _, test := range tests {
+		atomic.StoreInt32(&service.calls, 0)
+		response := ""
+		err := client.call("Controller.Call", &test.request, &response)
+		switch {
+		case test.message == "" && (err != nil || response != test.request):
+			t.Errorf("%s: got %q, err: %v", test.request, response, err)
+		case test.message != "" && (err == nil || err.Error() != test.message):
+			t.Errorf("%s: got the error %v, expected %q", test.request, err, test.message)
+		case test.err != nil && !errors.Is(err, test.err):
+			t.Errorf("%s: %v is not %v", test.request, err, test.err)
+		case errors.Is(err, ErrControllerUnreachable):
+			t.Errorf("%s: the reachable controller is reported unreachable: %v", test.request, err)
+		}
+		//errors returned by the handler are not retried
+		if calls := atomic.LoadInt32(&service.calls); calls != 1 {
+			t.Errorf("%s: called the controller %d times", test.request, calls)
+		}
+	}
+}
+
+func TestRPCControllerUnreachable(t *testing.T) {
+	quietLog(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	start := time.Now()
+	request, response := "ok", ""
+	err = newRPCClient(addr, 500*time.Millisecond).call("Controller.Call", &request, &response)
+	if !errors.Is(err, ErrControllerUnreachable) || !strings.Contains(err.Error(), addr) {
+		t.Fatalf("expected ErrControllerUnreachable for %s, got %v", addr, err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("gave up after %v with a deadline of 500ms", elapsed)
+	}
+}
+
+func TestRPCRetriesUntilTheControllerIsBack(t *testing.T) {
+	quietLog(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	//the controller restarts on the same address while the client retries
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		serveTestRPC(t, listener)
+	}()
+
+	request, response := "ok", ""
+	if err := newRPCClient(addr, 10*time.Second).call("Controller.Call", &request, &response); err != nil || response != "ok" {
+		t.Fatalf("got %q, err: %v", response, err)
+	}
+}
+
+func TestRPCBackoff(t *testing.T) {
+	client := newRPCClient("127.0.0.1:0", 0)
+	if client.deadline != DefaultRPCDeadline {
+		t.Errorf("the default deadline is %v", client.deadline)
+	}
+	for attempt := 0; attempt < 70; attempt++ {
+		limit := maxRPCBackoff
+		if attempt < 10 && initialRPCBackoff<<uint(attempt) < limit {
+			limit = initialRPCBackoff << uint(attempt)
+		}
+		for i := 0; i < 20; i++ {
+			if backoff := client.backoff(attempt); backoff <= 0 || backoff > limit+time.Millisecond {
+				t.Fatalf("the backoff of attempt %d is %v, limit %v", attempt, backoff, limit)
+			}
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package distributed
+
+import (
+	"fmt"
+	"gomr.com/gomr/input"
+	"gomr.com/gomr/mr"
+	"gomr.com/gomr/utils"
+	"io"
+	"log"
+	"math/rand"
+)
+
+/**
+Partitioners selectable for a job. Without one the Partition function of the plugin is used
+if it exports one, otherwise the hash partitioner.
+*/
+const (
+	HashPartitioner  = "hash"
+	RangePartitioner = "range"
+
+	DefaultSampleSize = 10000 //keys sampled for the range partitioner
+
+	maxSampledSplits = 10
+)
+
+/**
+Samples the map output keys for the range partitioner and returns its boundaries.
+
+The Map function is run on the first records of up to maxSampledSplits splits spread
+evenly over the input, and sampleSize keys are picked uniformly from its output.
+*/
+func sampleBoundaries(
+	plugin *utils.Plugin,
+	inputFormat input.InputFormat,
+	splits []input.Split,
+	nReduce int,
+	sampleSize int,
+) ([]string, error) {
+	if plugin == nil {
+		return nil, fmt.Errorf("the range partitioner needs the plugin to sample the map output keys")
+	}
+	if sampleSize <= 0 {
+		sampleSize = DefaultSampleSize
+	}
+	sampledSplits := len(splits)
+	if sampledSplits > maxSampledSplits {
+		sampledSplits = maxSampledSplits
+	}
+	if sampledSplits == 0 {
+		return []string{}, nil
+	}
+	keysPerSplit := (sampleSize + sampledSplits - 1) / sampledSplits
+
+	sample := []string{}
+	for i := 0; i < sampledSplits; i++ {
+		split := splits[i*len(splits)/sampledSplits]
+		keys, err := sampleSplit(plugin, inputFormat, split, keysPerSplit)
+		if err != nil {
+			return nil, err
+		}
+		sample = append(sample, keys...)
+	}
+	boundaries := mr.SampleBoundaries(sample, nReduce)
+	log.Printf("Sampled %d keys from %d splits into %d range boundaries", len(sample), sampledSplits, len(boundaries))
+	return boundaries, nil
+}
+
+/**
+Reservoir samples maxKeys of the keys emitted for the first maxKeys records of the split.
+*/
+func sampleSplit(
+	plugin *utils.Plugin, inputFormat input.InputFormat, split input.Split, maxKeys int,
+) (sample []string, err error) {
+	//a panic of the plugin rejects the job instead of stopping the controller and its other jobs
+	defer func() {
+		if r := recover(); r != nil {
+			sample, err = nil, fmt.Errorf("the Map function of the plugin panicked while sampling %v: %v", split, r)
+		}
+	}()
+	records, err := inputFormat.Open(split)
+	if err != nil {
+		return nil, err
+	}
+	defer records.Close()
+
+	//fixed seed, the same input always gives the same boundaries
+	random := rand.New(rand.NewSource(1))
+	keys := []string{}
+	seen := 0
+	for read := 0; read < maxKeys; read++ {
+		key, value, err := records.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, kv := range plugin.Map(key, value) {
+			seen++
+			if len(keys) < maxKeys {
+				keys = append(keys, kv.Key)
+			} else if i := random.Intn(seen); i < maxKeys {
+				keys[i] = kv.Key
+			}
+		}
+	}
+	return keys, nil
+}
+
+/**
+Returns the partition function of a map task.
+*/
+func partitionFunc(plugin *utils.Plugin, partitioner string, boundaries []string) func(string, int) int {
+	switch partitioner {
+	case RangePartitioner:
+		return mr.RangePartitioner{Boundaries: boundaries}.Partition
+	case HashPartitioner:
+		return mr.HashPartition
+	}
+	if plugin.Partition != nil {
+		return plugin.Partition
+	}
+	return mr.HashPartition
+}
@@ -0,0 +1,279 @@
+package distributed
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+/**
+Address the shuffle server of a worker listens on by default, any free port on all interfaces.
+*/
+const DefaultShuffleAddr = ":0"
+
+/**
+URL path prefix of the map outputs, /shuffle/<jobid>/mr-<map>-<reduce>-<attempt>.
+*/
+const shufflePathPrefix = "/shuffle/"
+
+/**
+URL path prefix of the reduce outputs, /output/<jobid>/mr-out-<reduce>.
+*/
+const outputPathPrefix = "/output/"
+
+/**
+How long the controller waits for a shuffle server when it checks a map or reduce output.
+*/
+const shuffleCheckTimeout = 2 * time.Second
+
+var (
+	shuffleJobIdPattern = regexp.MustCompile(`^[0-9A-Za-z-]+$`)
+	shuffleNamePattern  = regexp.MustCompile(`^mr-[0-9]+-[0-9]+-[0-9]+$`)
+	outputNamePattern   = regexp.MustCompile(`^mr-out-[0-9]+$`)
+)
+
+/**
+Serves the map outputs written by the worker, the reducers of any host pull their partitions
+from it. It also serves the reduce outputs the worker committed, e.g. for the controller to
+check they still exist.
+*/
+type shuffleServer struct {
+	listener net.Listener
+	addr     string //host:port advertised to the controller
+}
+
+/**
+Starts the shuffle server on listenAddr, host:port. Without a host the server listens on all
+interfaces and advertises the host name of the worker.
+*/
+func startShuffleServer(listenAddr string) (*shuffleServer, error) {
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return nil, err
+	}
+	host, _, err := net.SplitHostPort(listenAddr)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		if host, err = os.Hostname(); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	s := &shuffleServer{listener: listener, addr: net.JoinHostPort(host, port)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(shufflePathPrefix, func(w http.ResponseWriter, r *http.Request) {
+		serveJobFile(w, r, shufflePathPrefix, shuffleNamePattern, jobMapDir)
+	})
+	mux.HandleFunc(outputPathPrefix, func(w http.ResponseWriter, r *http.Request) {
+		serveJobFile(w, r, outputPathPrefix, outputNamePattern, jobOutputDir)
+	})
+	go http.Serve(listener, mux)
+	log.Printf("Shuffle server listening on %v, advertised as %s", listener.Addr(), s.addr)
+	return s, nil
+}
+
+/**
+Serves the file <prefix><jobid>/<name> from the directory of the job given by dir.
+*/
+func serveJobFile(
+	w http.ResponseWriter, r *http.Request, prefix string, namePattern *regexp.Regexp, dir func(string) string,
+) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, prefix), "/")
+	if len(parts) != 2 || !shuffleJobIdPattern.MatchString(parts[0]) || !namePattern.MatchString(parts[1]) {
+		http.NotFound(w, r)
+		return
+	}
+	file, err := os.Open(filepath.Join(dir(parts[0]), parts[1]))
+	if err != nil {
+		log.Printf("Unable to serve %v, err: %v", r.URL.Path, err)
+		http.NotFound(w, r)
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.ServeContent(w, r, parts[1], info.ModTime(), file)
+}
+
+func (s *shuffleServer) close() {
+	s.listener.Close()
+}
+
+/**
+A map output a reducer could not fetch, e.g. because the worker which served it is gone.
+*/
+type fetchError struct {
+	mapTaskId int
+	attempt   int
+	err       error
+}
+
+func (e *fetchError) Error() string {
+	return fmt.Sprintf("cannot fetch the output of map task %d attempt %d, err: %v", e.mapTaskId, e.attempt, e.err)
+}
+
+func (e *fetchError) Unwrap() error {
+	return e.err
+}
+
+/**
+URL of the partition reduceTaskId of the map task attempt served from location.
+*/
+func mapOutputURL(location string, jobId string, mapTaskId int, reduceTaskId int, attempt int) string {
+	return "http://" + location + shufflePathPrefix + jobId + "/" + mapOutputName(mapTaskId, reduceTaskId, attempt)
+}
+
+/**
+URL of the output file of the reduce task served from location.
+*/
+func reduceOutputURL(location string, jobId string, reduceTaskId int) string {
+	return "http://" + location + outputPathPrefix + jobId + "/" + reduceOutputName(reduceTaskId)
+}
+
+/**
+Downloads the map output at url into the file path and verifies it while it arrives, a corrupt
+or truncated map output is an error wrapping errCorruptIntermediate.
+*/
+func fetchMapOutput(url string, path string) error {
+	response, err := http.Get(url)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching %v returned %s", url, response.Status)
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = verifyRecords(io.TeeReader(response.Body, file))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("fetching %v failed, err: %w", url, err)
+	}
+	return nil
+}
+
+/**
+Checks if the map or reduce output at url can still be fetched from its shuffle server.
+*/
+func outputAvailable(url string) bool {
+	client := http.Client{Timeout: shuffleCheckTimeout}
+	response, err := client.Head(url)
+	if err != nil {
+		return false
+	}
+	response.Body.Close()
+	return response.StatusCode == http.StatusOK
+}
+
+func (c *Controller) ReportFetchFailure(request *ReportFetchFailureRequest, response *ReportFetchFailureResponse) error {
+	log.Printf(
+		"Handling fetch failure of reduce task: %d attempt %d of job %s by %s, map task: %d attempt %d, err: %s",
+		request.TaskId, request.Attempt, request.JobId, request.WorkerId, request.MapTaskId, request.MapAttempt,
+		request.Error,
+	)
+	j, err := c.job(request.JobId)
+	if err != nil {
+		return err
+	}
+	t, ok := j.reduceTasks[request.TaskId]
+	if !ok {
+		return fmt.Errorf("unknown reduce task %d of job %s", request.TaskId, request.JobId)
+	}
+	m, ok := j.mapTasks[request.MapTaskId]
+	if !ok {
+		return fmt.Errorf("unknown map task %d of job %s", request.MapTaskId, request.JobId)
+	}
+
+	//the reduce attempt is not to blame, it runs again once the map output is back
+	t.mx.Lock()
+	if a := t.runningAttempt(request.Attempt); t.state == Assigned && a != nil {
+		a.finish(attemptAborted, request.Error)
+		j.workers.assignTask(ReducePhase, a.workerId, TaskRef{JobId: j.id, TaskId: request.TaskId}, false)
+		if len(t.running()) == 0 {
+			t.state = Unassigned
+		}
+		j.journalTask(ReducePhase, request.TaskId, t)
+	}
+	t.mx.Unlock()
+
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	if m.state != Completed || m.skipped || m.accepted != request.MapAttempt {
+		log.Printf("Ignoring the fetch failure of the stale attempt %d of map task: %d", request.MapAttempt, request.MapTaskId)
+		return nil
+	}
+	j.loseMapOutput(request.MapTaskId, m, fmt.Sprintf("reduce task %d could not fetch it", request.TaskId))
+	return nil
+}
+
+func (w *worker) reportFetchFailure(jobId string, taskId int, attempt int, fetchErr *fetchError) error {
+	log.Printf("Calling Controller.ReportFetchFailure")
+	request := ReportFetchFailureRequest{
+		WorkerId: w.id, JobId: jobId, TaskId: taskId, Attempt: attempt, MapTaskId: fetchErr.mapTaskId,
+		MapAttempt: fetchErr.attempt, Error: fetchErr.Error(),
+	}
+	response := ReportFetchFailureResponse{}
+	if err := w.client.call("Controller.ReportFetchFailure", &request, &response); err != nil {
+		return err
+	}
+	log.Printf("Got the response form Controller.ReportFetchFailure: %v\n", response)
+	return nil
+}
+
+/**
+Hands out the map task again whose accepted output can no longer be fetched, the reduce tasks
+wait until it completed again. The accepted attempt and its location are kept until then, a
+reducer handed them out meanwhile fails to fetch them and its report is ignored as stale.
+The task lock is held by the caller.
+*/
+func (j *job) loseMapOutput(taskId int, t *task, reason string) {
+	log.Printf("Lost the output of map task %d attempt %d of job %s, %s, running it again", taskId, t.accepted, j.id, reason)
+	if a := t.acceptedAttempt(); a != nil {
+		a.status = attemptLost
+		a.err = reason
+	}
+	t.state = Unassigned
+	j.mx.Lock()
+	j.mapTasksCompleted = false
+	j.mapOutputsLost++
+	j.mx.Unlock()
+	j.journalTask(MapPhase, taskId, t)
+}
+
+/**
+Loses the map outputs served by the worker, unless no reduce task of the job is left to fetch
+them.
+*/
+func (j *job) loseMapOutputs(workerId string) {
+	if j.failure() != nil || j.isReduceTaskCompleted() {
+		return
+	}
+	for i := 0; i < j.numMap; i++ {
+		t := j.mapTasks[i]
+		t.mx.Lock()
+		if a := t.acceptedAttempt(); a != nil && a.workerId == workerId {
+			j.loseMapOutput(i, t, "its worker "+workerId+" is gone")
+		}
+		t.mx.Unlock()
+	}
+}
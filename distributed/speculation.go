@@ -0,0 +1,74 @@
+package distributed
+
+import (
+	"log"
+	"time"
+)
+
+/**
+When a backup attempt of a straggler is started: once speculativeCompleted of the tasks of
+the phase completed, for a task whose only attempt ran speculativeSlowdown times longer than
+the median task, and at least speculativeMinRuntime. With adaptive timeouts the runtime of a
+straggler follows the observed task durations instead, see taskTimeout.straggler.
+*/
+const (
+	speculativeCompleted  = 0.75
+	speculativeSlowdown   = 2
+	speculativeMinRuntime = 2 * time.Second
+)
+
+/**
+Starts a backup attempt of the slowest straggler of the phase on the idle worker. Both attempts
+keep running, the first one to complete the task wins. Returns the task id and the attempt
+number, the task id is -1 if there is no straggler.
+*/
+func (j *job) speculate(phase string, workerId string) (int, int) {
+	tasks := j.tasks(phase)
+	median, ok := j.timeout(phase).median()
+	if !ok {
+		return -1, 0
+	}
+	threshold := speculativeSlowdown * median
+	if adaptive, ok := j.timeout(phase).straggler(); ok {
+		threshold = adaptive
+	}
+	if threshold < speculativeMinRuntime {
+		threshold = speculativeMinRuntime
+	}
+
+	completed := 0
+	straggler := -1
+	var slowest time.Duration
+	for i, t := range tasks {
+		t.mx.Lock()
+		if t.state == Completed {
+			completed++
+		}
+		if running := t.running(); t.state == Assigned && len(running) == 1 && running[0].workerId != workerId {
+			if runtime := time.Since(running[0].start); runtime > threshold && runtime > slowest {
+				straggler = i
+				slowest = runtime
+			}
+		}
+		t.mx.Unlock()
+	}
+	if straggler == -1 || float64(completed) < speculativeCompleted*float64(len(tasks)) {
+		return -1, 0
+	}
+
+	t := tasks[straggler]
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	//the straggler may have completed in the meantime
+	if t.state != Assigned || len(t.running()) != 1 {
+		return -1, 0
+	}
+	attempt := t.assignTask(workerId)
+	j.journalTask(phase, straggler, t)
+	j.workers.assignTask(phase, workerId, TaskRef{JobId: j.id, TaskId: straggler}, true)
+	log.Printf(
+		"Assigning backup attempt %d of %s task %d of job %s to the worker %s, it ran for %v, median %v", attempt,
+		phase, straggler, j.id, workerId, slowest.Round(time.Millisecond), median.Round(time.Millisecond),
+	)
+	return straggler, attempt
+}
@@ -0,0 +1,88 @@
+package distributed
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSpeculation(t *testing.T) {
+	quietLog(t)
+	second := time.Second
+	w2 := "worker-2"
+	typical := []time.Duration{second, second, second} //median of one second
+	tests := []struct {
+		name        string
+		speculative bool
+		adaptive    bool
+		completed   int             //completed tasks
+		durations   []time.Duration //recorded durations of the completed tasks
+		runtimes    []time.Duration //of the running tasks on worker-1, one attempt each
+		backedUp    bool            //the running tasks already have a backup attempt
+		workerId    string          //idle worker asking for a task
+		backup      int             //task getting a backup attempt, -1 for none
+	}{
+		{"straggler", true, false, 3, typical, []time.Duration{10 * second}, false, w2, 3},
+		{"speculation disabled", false, false, 3, typical, []time.Duration{10 * second}, false, w2, -1},
+		{"too few tasks completed", true, false, 2, typical, []time.Duration{10 * second, 10 * second}, false, w2, -1},
+		{"no durations recorded", true, false, 3, nil, []time.Duration{10 * second}, false, w2, -1},
+		{"not slow enough", true, false, 3, []time.Duration{second, 4 * second, 4 * second}, []time.Duration{7 * second}, false, w2, -1},
+		{"shorter than the minimum", true, false, 3, []time.Duration{time.Millisecond}, []time.Duration{second}, false, w2, -1},
+		{"worker of the straggler", true, false, 3, typical, []time.Duration{10 * second}, false, "worker-1", -1},
+		{"backup running", true, false, 3, typical, []time.Duration{10 * second}, true, w2, -1},
+		{"slowest straggler", true, false, 6, typical, []time.Duration{10 * second, 20 * second}, false, w2, 7},
+		{"adaptive below the runtime", true, true, 3, typical, []time.Duration{4 * second}, false, w2, -1},
+		{"adaptive above the runtime", true, true, 3, typical, []time.Duration{6 * second}, false, w2, 3},
+	}
+	for _, phase := range []string{MapPhase, ReducePhase} {
+		for _, test := range tests {
+			numTasks := test.completed + len(test.runtimes)
+			spec := testJobSpec(numTasks, numTasks, 4)
+			spec.Speculative = test.speculative
+			spec.AdaptiveTimeout = test.adaptive
+			j := newTestJob(t, newTestController(), spec)
+			tasks := j.tasks(phase)
+			for i := 0; i < test.completed; i++ {
+				tasks[i].state = Completed
+			}
+			for _, duration := range test.durations {
+				j.timeout(phase).record(duration)
+			}
+			for i, runtime := range test.runtimes {
+				task := tasks[test.completed+i]
+				task.assignTask("worker-1")
+				task.attempts[0].start = time.Now().Add(-runtime)
+				if test.backedUp {
+					task.assignTask("worker-3")
+				}
+			}
+
+			taskId, attempt := j.assignTask(phase, test.workerId)
+			if taskId != test.backup {
+				t.Errorf("%s %s: got a backup attempt of task %d, expected task %d", phase, test.name, taskId, test.backup)
+				continue
+			}
+			if taskId == -1 {
+				continue
+			}
+			task := tasks[taskId]
+			if attempt != 2 || len(task.running()) != 2 || task.running()[1].workerId != test.workerId {
+				t.Errorf("%s %s: started attempt %d, running %v", phase, test.name, attempt, task.running())
+			}
+			//the first attempt to complete the task wins
+			completeTestAttempt(j, phase, taskId, attempt)
+			if task.state != Completed || task.accepted != 2 || task.attempts[0].status != attemptKilled {
+				t.Errorf(
+					"%s %s: the task is %v, accepted %d, first attempt %v", phase, test.name, task.state, task.accepted,
+					task.attempts[0],
+				)
+			}
+		}
+	}
+}
+
+func completeTestAttempt(j *job, phase string, taskId int, attempt int) {
+	task := j.tasks(phase)[taskId]
+	task.mx.Lock()
+	defer task.mx.Unlock()
+	j.completeTask(phase, taskId, task, task.runningAttempt(attempt))
+}
@@ -0,0 +1,94 @@
+package distributed
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	//ten missed heartbeats
+	DefaultTaskTimeout = 10 * heartbeatInterval
+
+	//adaptive straggler runtimes
+	adaptiveMinSamples = 3                //completed tasks needed before adapting
+	adaptiveFactor     = 3                //multiple of the slowest typical task duration
+	adaptiveMinRuntime = 5 * time.Second  //never speculate on a task which ran shorter
+	adaptiveMaxRuntime = 30 * time.Minute //always speculate on a task which ran longer
+)
+
+/**
+Lease duration and observed durations of the tasks of one phase (map or reduce). The workers
+renew the leases of the tasks they hold with heartbeats, a task is reassigned once its lease
+expired. The lease only measures the time since the last heartbeat, it stays fixed however long
+the tasks run.
+
+The durations of the completed tasks decide when a running task is a straggler which gets a
+backup attempt, see speculate. With adaptive timeouts that is adaptiveFactor times their 90th
+percentile, clamped to [adaptiveMinRuntime, adaptiveMaxRuntime].
+*/
+type taskTimeout struct {
+	mx        sync.Mutex
+	timeout   time.Duration
+	adaptive  bool
+	durations []time.Duration //durations of the completed tasks, sorted
+}
+
+func newTaskTimeout(timeout time.Duration, adaptive bool) *taskTimeout {
+	if timeout <= 0 {
+		timeout = DefaultTaskTimeout
+	}
+	return &taskTimeout{timeout: timeout, adaptive: adaptive}
+}
+
+/**
+Records the duration of a completed task.
+*/
+func (t *taskTimeout) record(duration time.Duration) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	i := sort.Search(len(t.durations), func(i int) bool { return t.durations[i] >= duration })
+	t.durations = append(t.durations, 0)
+	copy(t.durations[i+1:], t.durations[i:])
+	t.durations[i] = duration
+}
+
+/**
+Returns the lease duration of a task.
+*/
+func (t *taskTimeout) lease() time.Duration {
+	return t.timeout
+}
+
+/**
+Returns the runtime after which a running task is a straggler, adapted to the observed task
+durations. False unless adaptive timeouts are enabled and enough tasks completed.
+*/
+func (t *taskTimeout) straggler() (time.Duration, bool) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	if !t.adaptive || len(t.durations) < adaptiveMinSamples {
+		return 0, false
+	}
+	p90 := t.durations[len(t.durations)*9/10]
+	runtime := adaptiveFactor * p90
+	if runtime < adaptiveMinRuntime {
+		runtime = adaptiveMinRuntime
+	}
+	if runtime > adaptiveMaxRuntime {
+		runtime = adaptiveMaxRuntime
+	}
+	return runtime, true
+}
+
+/**
+Returns the median duration of the completed tasks, false if no task completed yet.
+*/
+func (t *taskTimeout) median() (time.Duration, bool) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	if len(t.durations) == 0 {
+		return 0, false
+	}
+	return t.durations[len(t.durations)/2], true
+}
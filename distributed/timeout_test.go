@@ -0,0 +1,44 @@
+package distributed
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLeaseIgnoresTaskDurations(t *testing.T) {
+	timeout := newTaskTimeout(0, true)
+	for i := 0; i < 10; i++ {
+		timeout.record(time.Hour)
+	}
+	if lease := timeout.lease(); lease != DefaultTaskTimeout {
+		t.Fatalf("the lease is %v after long tasks, expected %v", lease, DefaultTaskTimeout)
+	}
+}
+
+func TestStragglerRuntime(t *testing.T) {
+	tests := []struct {
+		adaptive  bool
+		durations []time.Duration
+		runtime   time.Duration
+		ok        bool
+	}{
+		{false, []time.Duration{time.Minute, time.Minute, time.Minute}, 0, false},
+		{true, []time.Duration{time.Minute, time.Minute}, 0, false},
+		{true, []time.Duration{time.Minute, time.Minute, 2 * time.Minute}, 6 * time.Minute, true},
+		{true, []time.Duration{time.Millisecond, time.Millisecond, time.Millisecond}, adaptiveMinRuntime, true},
+		{true, []time.Duration{time.Hour, time.Hour, time.Hour}, adaptiveMaxRuntime, true},
+	}
+	for _, test := range tests {
+		timeout := newTaskTimeout(time.Second, test.adaptive)
+		for _, duration := range test.durations {
+			timeout.record(duration)
+		}
+		runtime, ok := timeout.straggler()
+		if runtime != test.runtime || ok != test.ok {
+			t.Errorf("%v adaptive %v: got %v %v, expected %v %v", test.durations, test.adaptive, runtime, ok, test.runtime, test.ok)
+		}
+		if lease := timeout.lease(); lease != time.Second {
+			t.Errorf("%v: the lease is %v", test.durations, lease)
+		}
+	}
+}
@@ -1,280 +1,673 @@
 package distributed
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
-	"gomr.com/gomr/mr"
-	"hash/fnv"
+	"gomr.com/gomr/input"
+	"gomr.com/gomr/output"
+	"gomr.com/gomr/utils"
+	"io"
 	"io/ioutil"
 	"log"
-	"net/rpc"
 	"os"
 	"path/filepath"
 	"time"
 )
 
-const mapOutputDirName = "/tmp/gomr/map"
-const outputDirName = "/tmp/gomr/output"
+/**
+Name of the partition reduceTaskId written by the attempt of the map task mapTaskId.
+*/
+func mapOutputName(mapTaskId int, reduceTaskId int, attempt int) string {
+	return fmt.Sprintf("mr-%d-%d-%d", mapTaskId, reduceTaskId, attempt)
+}
+
+/**
+Name of the output file of the reduce task.
+*/
+func reduceOutputName(reduceTaskId int) string {
+	return fmt.Sprintf("mr-out-%d", reduceTaskId)
+}
+
+/**
+Removes the partitions written by the attempt of the map task to mapDir.
+*/
+func removeMapOutput(mapDir string, taskId int, nReduce int, attempt int) {
+	for i := 0; i < nReduce; i++ {
+		oldTempFile := mapOutputName(taskId, i, attempt)
+		err := os.Remove(filepath.Join(mapDir, oldTempFile))
+		if err == nil {
+			log.Printf("Deleted old tempFile, FileName= %v", oldTempFile)
+		}
+	}
+}
+
+/**
+Number of tasks a worker runs at once.
+*/
+const workerCapacity = 1
+
+/**
+How long a stopping worker tries to deregister from the controller.
+*/
+const deregisterDeadline = 2 * time.Second
+
+/**
+Configuration of a worker process.
+*/
+type WorkerConfig struct {
+	Addr        string        //controller address, see parseAddr
+	RPCDeadline time.Duration //how long to keep retrying an unreachable controller
+	SortBuffer  int64         //bytes of records a map task buffers before spilling a sorted run to disk
+	ShuffleAddr string        //host:port the shuffle server serving the map outputs listens on
+	PluginFile  string        //.so file of the plugin given to the worker, "" for none
+}
+
+/**
+Represents a running worker and the controller it talks to.
+*/
+type worker struct {
+	id             string //assigned by the controller on registration
+	addr           string
+	client         *rpcClient
+	heartbeats     *heartbeater
+	shuffle        *shuffleServer           //serves the outputs of the map tasks run by the worker
+	plugin         *utils.Plugin            //used by the jobs without a plugin of their own, may be nil
+	pluginHash     string                   //content hash of plugin, it also runs the jobs shipping the same plugin
+	plugins        map[string]*utils.Plugin //plugins of the jobs by hash, loaded on their first task
+	mapJobs        map[string]bool          //jobs the worker ran map tasks of
+	sortBufferSize int64
+}
 
-func checkForMapTasksCompletion() bool {
-	log.Printf("Calling Controller.CheckForMapTasksCompletion")
-	request := CheckForMapTasksCompletionRequest{}
-	response := CheckForMapTasksCompletionResponse{}
-	call("Controller.CheckForMapTasksCompletion", &request, &response)
-	log.Printf("Got ther response form Controller.CheckForMapTasksCompletion: %v\n", response)
-	return response.AllCompleted
+/**
+Registers the worker with the controller, which assigns its worker id.
+*/
+func (w *worker) register() error {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	log.Printf("Calling Controller.RegisterWorker")
+	request := RegisterWorkerRequest{Host: host, Pid: os.Getpid(), Capacity: workerCapacity}
+	response := RegisterWorkerResponse{}
+	if err := w.client.call("Controller.RegisterWorker", &request, &response); err != nil {
+		return err
+	}
+	log.Printf("Registered with the controller as %s", response.WorkerId)
+	w.id = response.WorkerId
+	w.heartbeats.setWorkerId(w.id)
+	return nil
+}
+
+/**
+Tells the controller the worker stops, so it can hand out the worker's tasks right away.
+*/
+func (w *worker) deregister() {
+	if w.id == "" {
+		return
+	}
+	log.Printf("Calling Controller.DeregisterWorker")
+	request := DeregisterWorkerRequest{WorkerId: w.id}
+	response := DeregisterWorkerResponse{}
+	client := newRPCClient(w.addr, deregisterDeadline)
+	if err := client.call("Controller.DeregisterWorker", &request, &response); err != nil {
+		log.Printf("Failed to deregister %s, err: %v", w.id, err)
+		return
+	}
+	log.Printf("Deregistered %s", w.id)
 }
 
-func getMapTask() (int, string, int) {
+func (w *worker) getMapTask() (GetMapTaskResponse, error) {
 	log.Printf("Calling Controller.GetMapTask")
-	request := GetMapTaskRequest{}
+	request := GetMapTaskRequest{WorkerId: w.id}
 	response := GetMapTaskResponse{}
-	call("Controller.GetMapTask", &request, &response)
+	if err := w.client.call("Controller.GetMapTask", &request, &response); err != nil {
+		return response, err
+	}
 	log.Printf("Got the response form Controller.GetMapTask: %v\n", response)
-	return response.TaskId, response.Filename, response.NumReduce
+	return response, nil
 }
 
-func updateMapTaskWithCompletion(taskId int) error {
+/**
+Reports the map task as completed, returns if the controller accepted the output of the attempt.
+*/
+func (w *worker) updateMapTaskWithCompletion(jobId string, taskId int, attempt int) (bool, error) {
 	log.Printf("Calling Controller.UpdateMapTask")
-	request := UpdateMapTaskRequest{TaskId: taskId}
+	request := UpdateMapTaskRequest{
+		WorkerId: w.id, JobId: jobId, TaskId: taskId, Attempt: attempt, ShuffleAddr: w.shuffle.addr,
+	}
 	response := UpdateMapTaskResponse{}
-	call("Controller.UpdateMapTask", &request, &response)
+	if err := w.client.call("Controller.UpdateMapTask", &request, &response); err != nil {
+		return false, err
+	}
 	log.Printf("Got the response form Controller.UpdateMapTask: %v\n", response)
-	return nil
-}
-
-func checkForReduceTasksCompletion() bool {
-	log.Printf("Calling Controller.CheckForReduceTasksCompletion")
-	request := CheckForReduceTasksCompletionRequest{}
-	response := CheckForReducdTasksCompletionResponse{}
-	call("Controller.CheckForReduceTasksCompletion", &request, &response)
-	log.Printf("Got ther response form Controller.CheckForReduceTasksCompletion: %v\n", response)
-	return response.AllCompleted
+	return response.Accepted, nil
 }
 
-func getReduceTask() (int, string) {
+func (w *worker) getReduceTask() (GetReduceTaskResponse, error) {
 	log.Printf("Calling Controller.GetReduceTask")
-	request := GetReduceTaskRequest{}
+	request := GetReduceTaskRequest{WorkerId: w.id}
 	response := GetReduceTaskResponse{}
-	call("Controller.GetReduceTask", &request, &response)
+	if err := w.client.call("Controller.GetReduceTask", &request, &response); err != nil {
+		return response, err
+	}
 	log.Printf("Got the response form Controller.GetReduceTask: %v\n", response)
-	return response.TaskId, response.Filename
+	return response, nil
 }
 
-func updateReduceTaskWithCompletion(taskId int) error {
+/**
+Asks the controller if the attempt of the reduce task may publish its output.
+*/
+func (w *worker) canCommitReduceTask(jobId string, taskId int, attempt int) (bool, error) {
+	log.Printf("Calling Controller.CanCommitReduceTask")
+	request := CanCommitReduceTaskRequest{WorkerId: w.id, JobId: jobId, TaskId: taskId, Attempt: attempt}
+	response := CanCommitReduceTaskResponse{}
+	if err := w.client.call("Controller.CanCommitReduceTask", &request, &response); err != nil {
+		return false, err
+	}
+	log.Printf("Got the response form Controller.CanCommitReduceTask: %v\n", response)
+	return response.Allowed, nil
+}
+
+/**
+Reports the reduce task as completed once its output is published, returns if the controller
+accepted this worker's output.
+*/
+func (w *worker) updateReduceTaskWithCompletion(jobId string, taskId int, attempt int) (bool, error) {
 	log.Printf("Calling Controller.UpdateReduceTask")
-	request := UpdateReduceTaskRequest{TaskId: taskId}
+	request := UpdateReduceTaskRequest{
+		WorkerId: w.id, JobId: jobId, TaskId: taskId, Attempt: attempt, ShuffleAddr: w.shuffle.addr,
+	}
 	response := UpdateReduceTaskResponse{}
-	call("Controller.UpdateReduceTask", &request, &response)
+	if err := w.client.call("Controller.UpdateReduceTask", &request, &response); err != nil {
+		return false, err
+	}
 	log.Printf("Got the response form Controller.UpdateReduceTask: %v\n", response)
+	return response.Accepted, nil
+}
+
+/**
+Reports the failure of the attempt of a map or reduce task to the controller.
+*/
+func (w *worker) reportTaskFailure(jobId string, phase string, taskId int, attempt int, taskErr error) error {
+	log.Printf("Calling Controller.ReportTaskFailure")
+	request := ReportTaskFailureRequest{
+		WorkerId: w.id, JobId: jobId, Phase: phase, TaskId: taskId, Attempt: attempt, Error: taskErr.Error(),
+		Refused: errors.Is(taskErr, errPluginConflict),
+	}
+	response := ReportTaskFailureResponse{}
+	if err := w.client.call("Controller.ReportTaskFailure", &request, &response); err != nil {
+		return err
+	}
+	log.Printf("Got the response form Controller.ReportTaskFailure: %v\n", response)
 	return nil
 }
 
+/**
+Publishes the output of a reduce task once the controller allowed it, discards it otherwise.
+Returns if the output was published.
+*/
+func commitOutput(outputFile *output.File, allowed bool) (bool, error) {
+	if !allowed {
+		log.Printf("The output %v was not allowed to commit by the controller, discarding it", outputFile.Name())
+		return false, outputFile.Abort()
+	}
+	if err := outputFile.Commit(); err != nil {
+		outputFile.Abort()
+		return false, fmt.Errorf("cannot commit the output file: %v, err: %w", outputFile.Name(), err)
+	}
+	log.Printf("Committed the output file: %v", outputFile.Name())
+	return true, nil
+}
+
 func Mapper(
-	mapf func(string, string) []mr.KeyValue,
-	filename string,
+	plugin *utils.Plugin,
+	inputFormat input.InputFormat,
+	split input.Split,
 	taskId int,
+	attempt int,
 	nReduce int,
-) error {
+	partition func(string, int) int,
+	sortBufferSize int64,
+	sorted bool,
+	format kvFormat,
+	mapDir string,
+) (err error) {
 	log.Printf("Starting Mapper for the worker\n")
-	//open the file and read all the contents to the memory
-	file, err := os.Open(filename)
-	if err != nil {
-		log.Fatalf("cannot open file: %v, err: %v", filename, err)
-	}
-	content, err := ioutil.ReadAll(file)
-
+	//a panic of the plugin fails the task instead of the worker
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("map task %d panicked: %v", taskId, r)
+		}
+	}()
+	records, err := inputFormat.Open(split)
 	if err != nil {
-		log.Fatalf("cannot read file: %v, err: %v", filename, err)
+		return fmt.Errorf("cannot open split: %v, err: %w", split, err)
 	}
-	file.Close()
-	log.Printf("Read the contents of the Map file: %v\n", filename)
+	defer records.Close()
+	log.Printf("Opened the Map split: %v\n", split)
 	//remove the older files generated from the operation
-	//removes for each map task mr-taskId-(0..nReduce]
-	for i := 0; i < nReduce; i++ {
-		oldTempFile := fmt.Sprintf("mr-%d-%d", taskId, i)
-		err := os.Remove(filepath.Join(mapOutputDirName, oldTempFile))
-		if err == nil {
-			log.Printf("Deleted old tempFile, FileName= %v", oldTempFile)
-		}
-	}
+	//removes for the attempt of the map task mr-taskId-(0..nReduce]-attempt
+	removeMapOutput(mapDir, taskId, nReduce, attempt)
 	log.Printf("Deleted all the temporary files if any\n")
-	keyValueArr := mapf(filename, string(content))
 
 	log.Printf("Moving the Key Value Array partition into reduce tasks\n")
 	/*
-		Partition the kevValue Array for nReduce operations
-		for each key it holds the KeyValue Array
+		Partition the kevValue Array of every record for nReduce operations. The sorter keeps
+		a bounded number of records in memory and spills sorted runs to disk.
 	*/
-	reduceKVArray := make(map[int][]mr.KeyValue)
+	sorter := newSpillSorter(nReduce, sortBufferSize, sorted, plugin.Combine, format)
+	defer sorter.close()
 
-	for _, val := range keyValueArr {
-		reduceKey := int(ihash(val.Key)) % nReduce
-		reduceKVArray[reduceKey] = append(reduceKVArray[reduceKey], val)
+	for {
+		key, value, err := records.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("cannot read split: %v, err: %w", split, err)
+		}
+		for _, val := range plugin.Map(key, value) {
+			reduceKey := partition(val.Key, nReduce)
+			if reduceKey < 0 || reduceKey >= nReduce {
+				return fmt.Errorf("partition of the key %q is %d, not in [0, %d)", val.Key, reduceKey, nReduce)
+			}
+			if err := sorter.add(reduceKey, val); err != nil {
+				return fmt.Errorf("failed to spill the sorted run for the map task: %d, err: %w", taskId, err)
+			}
+		}
 	}
 
 	log.Printf(
-		"Saving the partitioned KeyValue output into the files with mr-taskId-(0..nreduce-1)\n. " +
-			"The data is encoded into json before saving it into the file\n",
+		"Saving the sorted partitioned KeyValue output into the files with mr-taskId-(0..nreduce-1)-attempt\n. "+
+			"The data is encoded into the %s intermediate format before saving it into the file\n", format.name,
 	)
 	/*
 		Putting the Map % nReduce changes to reduce ready files.
 	*/
 	for i := 0; i < nReduce; i++ {
-		outputFileName := fmt.Sprintf("mr-%d-%d", taskId, i)
+		outputFileName := mapOutputName(taskId, i, attempt)
 		log.Printf("outputfile: %v\n", outputFileName)
 		outputFile, err := os.OpenFile(
-			filepath.Join(mapOutputDirName, outputFileName), os.O_RDWR|os.O_CREATE|os.O_EXCL, os.ModePerm,
+			filepath.Join(mapDir, outputFileName), os.O_RDWR|os.O_CREATE|os.O_EXCL, os.ModePerm,
 		)
 		if err != nil {
-			log.Fatalf(
-				"Failed to create output file for dir: %v and filename %v, err: %v", mapOutputDirName,
-				outputFileName, err,
+			return fmt.Errorf(
+				"failed to create output file for dir: %v and filename %v, err: %w", mapDir, outputFileName, err,
 			)
 		}
 
-		encoder := json.NewEncoder(outputFile)
-		for _, val := range reduceKVArray[i] {
-			err := encoder.Encode(&val)
-			if err != nil {
-				log.Fatalf(
-					"Cannot write to the outputdir: %v, outputfile: %v, err: %v", mapOutputDirName, outputFile, err,
-				)
-			}
-		}
-
+		err = sorter.writePartition(i, outputFile)
 		outputFile.Close()
+		if err != nil {
+			return fmt.Errorf(
+				"cannot write to the outputdir: %v, outputfile: %v, err: %w", mapDir, outputFileName, err,
+			)
+		}
 	}
 	log.Printf("Completed the Mapper operation\n")
 	return nil
 }
 
-func Reducer(reducef func(string, []string) string, taskId int, filename string) error {
-	log.Printf("Starting Reduce operation for the task: %d", taskId)
-
-	file, err := os.Open(filepath.Join(reduceDirPath, filename))
+/**
+Pulls the reduce partition taskId from the accepted attempt of every map task, i.e. the sorted
+files mr-(0..nMap-1)-taskId-attempt served by the shuffle servers in mapLocations, and merges
+them into a single key ordered stream. Unsorted files are grouped by key in memory instead, or
+sorted on disk first if they hold more than sortBufferSize bytes of records.
+
+Returns the grouped stream and a function releasing the fetched files.
+*/
+func shuffle(
+	jobId string, taskId int, mapAttempts []int, mapLocations []string, sorted bool, sortBufferSize int64,
+	format kvFormat,
+) (keyGroupIterator, func(), error) {
+	tmpDir, err := ioutil.TempDir("", "gomr-shuffle-")
 	if err != nil {
-		log.Fatalf("cannot open file: %v, err: %v", filename, err)
+		return nil, nil, err
 	}
-
-	log.Printf("Reading the contents for the reduce file: %s", filename)
-	decoder := json.NewDecoder(file)
-	keyValueArray := []mr.KeyValue{}
-	for {
-		var kv mr.KeyValue
-
-		if err := decoder.Decode(&kv); err != nil {
-			break
+	runs := []string{}
+	for i, attempt := range mapAttempts {
+		if attempt == 0 {
+			//the map task was skipped after it failed, it has no output
+			continue
+		}
+		url := mapOutputURL(mapLocations[i], jobId, i, taskId, attempt)
+		path := filepath.Join(tmpDir, mapOutputName(i, taskId, attempt))
+		if err := fetchMapOutput(url, path); err != nil {
+			os.RemoveAll(tmpDir)
+			return nil, nil, &fetchError{mapTaskId: i, attempt: attempt, err: err}
 		}
-		keyValueArray = append(keyValueArray, kv)
+		runs = append(runs, path)
 	}
-	file.Close()
-
-	outputFileName := fmt.Sprintf("mr-out-%d", taskId)
+	log.Printf("Fetched the partition %d from %d map outputs", taskId, len(runs))
 
-	//removing older files
-	err = os.Remove(filepath.Join(outputDirName, outputFileName))
-	if err == nil {
-		log.Printf("Removed the old output file: %s in directory %s", outputFileName, outputDirName)
+	readers := []*runReader{}
+	closeReaders := func() {
+		for _, r := range readers {
+			r.Close()
+		}
+		readers = nil
 	}
-
-	reduceOutputMap := make(map[string]string)
-	for i := 0; i < len(keyValueArray); {
-		j := i
-		values := []string{}
-		for ; j < len(keyValueArray) && keyValueArray[i].Key == keyValueArray[j].Key; {
-			values = append(values, keyValueArray[j].Value)
-			j++
+	release := func() {
+		closeReaders()
+		os.RemoveAll(tmpDir)
+	}
+	openRuns := func() ([]kvIterator, error) {
+		sources := []kvIterator{}
+		for _, run := range runs {
+			r, err := openRun(run)
+			if err != nil {
+				return nil, err
+			}
+			readers = append(readers, r)
+			sources = append(sources, r)
 		}
-		output := reducef(keyValueArray[i].Key, values)
-		reduceOutputMap[keyValueArray[i].Key] = output
-		i = j
+		return sources, nil
 	}
 
-	outputFile, err := os.OpenFile(
-		filepath.Join(outputDirName, outputFileName), os.O_RDWR|os.O_CREATE|os.O_EXCL, os.ModePerm,
-	)
-
-	if err != nil {
-		log.Fatalf(
-			"Failed to create output file for dir: %v and filename %v, err: %v", outputDirName,
-			outputFileName, err,
-		)
+	if !sorted {
+		sources, err := openRuns()
+		if err != nil {
+			release()
+			return nil, nil, err
+		}
+		groups := newHashGroupIterator(sources, sortBufferSize)
+		err = groups.load()
+		if err == nil {
+			return groups, release, nil
+		}
+		closeReaders()
+		if err != errGroupLimit {
+			release()
+			return nil, nil, err
+		}
+		log.Printf("The partition %d exceeds %d bytes, sorting it on disk", taskId, sortBufferSize)
+		runs, err = sortRuns(runs, tmpDir, sortBufferSize, format)
+		if err != nil {
+			release()
+			return nil, nil, err
+		}
 	}
-
-	for key, value := range reduceOutputMap {
-		fmt.Fprintf(outputFile, "%v %v\n", key, value)
+	if len(runs) > mergeFactor {
+		runs, err = reduceRuns(runs, tmpDir, nil, format)
+		if err != nil {
+			release()
+			return nil, nil, err
+		}
 	}
-	outputFile.Close()
-	log.Printf("Reduce operation completed.")
-	return nil
+	sources, err := openRuns()
+	if err != nil {
+		release()
+		return nil, nil, err
+	}
+	return newGroupIterator(newMergeIterator(sources)), release, nil
 }
 
-func Worker(
-	mapf func(string, string) []mr.KeyValue,
+/**
+Runs the reduce task and writes its output under a temporary name. The returned file is
+published with Commit once the controller accepted the task, or discarded with Abort.
+*/
+func Reducer(
 	reducef func(string, []string) string,
-) {
-	err := os.Mkdir(mapOutputDirName, os.ModePerm)
+	outputFormat output.OutputFormat,
+	outputCodec string,
+	jobId string,
+	taskId int,
+	mapAttempts []int,
+	mapLocations []string,
+	sorted bool,
+	sortBufferSize int64,
+	format kvFormat,
+	outputDir string,
+) (outputFile *output.File, err error) {
+	log.Printf("Starting Reduce operation for the task: %d", taskId)
+	//a panic of the plugin fails the task instead of the worker
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("reduce task %d panicked: %v", taskId, r)
+		}
+		if err != nil && outputFile != nil {
+			outputFile.Abort()
+			outputFile = nil
+		}
+	}()
 
+	log.Printf("Merging the partition %d from the output of %d map tasks", taskId, len(mapAttempts))
+	groups, release, err := shuffle(jobId, taskId, mapAttempts, mapLocations, sorted, sortBufferSize, format)
 	if err != nil {
-		log.Printf("Failed to create temp directory: %v for processing, err: %v", mapOutputDirName, err)
+		return nil, fmt.Errorf("cannot read the partition: %d, err: %w", taskId, err)
 	}
+	defer release()
 
-	log.Printf("Executing Map Tasks")
-	for ; !checkForMapTasksCompletion(); {
-		taskId, filename, nReduce := getMapTask()
-		if taskId == -1 {
-			log.Println("Didn't find any available Task")
-			time.Sleep(1000 * time.Millisecond)
-			continue
+	outputFileName := reduceOutputName(taskId)
+	outputFile, err = output.Create(outputDir, outputFileName, outputFormat, outputCodec)
+	if err != nil {
+		return nil, fmt.Errorf(
+			"failed to create output file for dir: %v and filename %v, err: %w", outputDir, outputFileName, err,
+		)
+	}
+
+	//the output of each key group is written as soon as it is reduced, in key order if sorted
+	for {
+		key, values, err := groups.NextGroup()
+		if err == io.EOF {
+			break
 		}
-		err := Mapper(mapf, filename, taskId, nReduce)
-		if err == nil {
-			updateMapTaskWithCompletion(taskId)
+		if err != nil {
+			return outputFile, fmt.Errorf("cannot read the partition: %d, err: %w", taskId, err)
 		}
-		time.Sleep(1 * time.Second)
+		if err := outputFile.Write(key, reducef(key, values)); err != nil {
+			return outputFile, fmt.Errorf("cannot write to the output file: %v, err: %w", outputFileName, err)
+		}
+	}
+	if err := outputFile.Close(); err != nil {
+		return outputFile, fmt.Errorf("cannot write to the output file: %v, err: %w", outputFileName, err)
 	}
+	log.Printf("Reduce operation completed.")
+	return outputFile, nil
+}
 
-	err = os.Mkdir(outputDirName, os.ModePerm)
+/**
+Runs the Map and Reduce tasks of the jobs handed out by the Controller. The plugin is used for
+the jobs submitted without a plugin of their own, it may be nil.
+
+Returns nil once the controller reports its jobs as done, and an error if the controller
+becomes unreachable or an RPC fails.
+*/
+func Worker(plugin *utils.Plugin, config WorkerConfig) error {
+	w := &worker{
+		addr:           config.Addr,
+		client:         newRPCClient(config.Addr, config.RPCDeadline),
+		heartbeats:     newHeartbeater(config.Addr),
+		plugin:         plugin,
+		plugins:        make(map[string]*utils.Plugin),
+		mapJobs:        make(map[string]bool),
+		sortBufferSize: config.SortBuffer,
+	}
+	if config.PluginFile != "" {
+		data, err := ioutil.ReadFile(config.PluginFile)
+		if err != nil {
+			return fmt.Errorf("cannot read the plugin %v, err: %w", config.PluginFile, err)
+		}
+		w.pluginHash = pluginHash(data)
+	}
+	shuffle, err := startShuffleServer(config.ShuffleAddr)
 	if err != nil {
-		log.Printf("Failed to create output directory: %v for processing, err: %v", outputDirName, err)
+		return fmt.Errorf("cannot start the shuffle server on %v, err: %w", config.ShuffleAddr, err)
 	}
+	defer shuffle.close()
+	w.shuffle = shuffle
+	err = w.register()
+	if err == nil {
+		w.heartbeats.start()
+		err = w.run()
+		w.heartbeats.close()
+		if !errors.Is(err, ErrControllerUnreachable) {
+			w.deregister()
+		}
+	}
+	if errors.Is(err, ErrJobDone) {
+		log.Printf("Controller reported the job as done, stopping")
+		//all the jobs ended, the heartbeats may not have told the worker about the last ones
+		for jobId := range w.mapJobs {
+			removeJobMapOutputs(jobId)
+		}
+		return nil
+	}
+	return err
+}
 
-	log.Printf("Executing Reduce Tasks")
-	for ; !checkForReduceTasksCompletion(); {
-		taskId, filename := getReduceTask()
-		if taskId == -1 {
-			log.Println("Didn't find any available Task")
-			time.Sleep(1000 * time.Millisecond)
+/**
+Asks for a map task of any job, or else a reduce task, until the controller reports its jobs
+as done.
+*/
+func (w *worker) run() error {
+	log.Printf("Executing Map/Reduce Tasks")
+	for {
+		mapTask, err := w.getMapTask()
+		if errors.Is(err, ErrUnknownWorker) {
+			err = w.register()
+			if err == nil {
+				continue
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if mapTask.TaskId != -1 {
+			if err := w.runMapTask(mapTask); err != nil {
+				return err
+			}
+			time.Sleep(1 * time.Second)
 			continue
 		}
-		err := Reducer(reducef, taskId, filename)
-		if err == nil {
-			updateReduceTaskWithCompletion(taskId)
+
+		reduceTask, err := w.getReduceTask()
+		if errors.Is(err, ErrUnknownWorker) {
+			err = w.register()
+			if err == nil {
+				continue
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if reduceTask.TaskId != -1 {
+			if err := w.runReduceTask(reduceTask); err != nil {
+				return err
+			}
+			time.Sleep(1 * time.Second)
+			continue
 		}
-		time.Sleep(1 * time.Second)
-	}
-	log.Printf("All worker Map/Reduce tasks completed, stopping")
 
+		log.Println("Didn't find any available Task")
+		time.Sleep(1000 * time.Millisecond)
+	}
 }
 
-func call(api string, request interface{}, response interface{}) bool {
-	c, err := rpc.DialHTTP("tcp", "127.0.0.1"+":1234")
-	if err != nil {
-		log.Fatalf("Failed with err: %v", err)
+/**
+Runs the map task and reports its completion, or its failure, to the controller. A failed task
+does not stop the worker, only the errors of the RPCs are returned.
+*/
+func (w *worker) runMapTask(task GetMapTaskResponse) error {
+	ref := TaskRef{JobId: task.JobId, TaskId: task.TaskId}
+	w.heartbeats.holdMapTask(ref, true)
+	defer w.heartbeats.holdMapTask(ref, false)
+
+	mapDir := jobMapDir(task.JobId)
+	w.mapJobs[task.JobId] = true
+	plugin, err := w.loadPlugin(task.JobId, task.PluginHash)
+	if err == nil {
+		err = os.MkdirAll(mapDir, os.ModePerm)
 	}
-	defer c.Close()
-
-	err = c.Call(api, request, response)
+	var inputFormat input.InputFormat
 	if err == nil {
-		return true
+		inputFormat, err = input.Lookup(task.InputFormat)
+	}
+	var format kvFormat
+	if err == nil {
+		format, err = newKVFormat(task.IntermediateFormat, task.IntermediateCodec)
+	}
+	if err == nil {
+		split := input.Split{Filename: task.Filename, Offset: task.Offset, Length: task.Length}
+		partition := partitionFunc(plugin, task.Partitioner, task.RangeBoundaries)
+		err = Mapper(
+			plugin, inputFormat, split, task.TaskId, task.Attempt, task.NumReduce, partition, w.sortBufferSize,
+			!task.NoSort, format, mapDir,
+		)
+	}
+	if err != nil {
+		log.Printf("The attempt %d of map task %d of job %s failed, err: %v", task.Attempt, task.TaskId, task.JobId, err)
+		removeMapOutput(mapDir, task.TaskId, task.NumReduce, task.Attempt)
+		return w.reportTaskFailure(task.JobId, MapPhase, task.TaskId, task.Attempt, err)
+	}
+	accepted, err := w.updateMapTaskWithCompletion(task.JobId, task.TaskId, task.Attempt)
+	if err == nil && !accepted {
+		log.Printf("The attempt %d of map task %d was not accepted, discarding its output", task.Attempt, task.TaskId)
+		removeMapOutput(mapDir, task.TaskId, task.NumReduce, task.Attempt)
 	}
-	log.Fatalf("Failed with err: %v", err)
-	return false
+	return err
 }
 
-func ihash(key string) int {
-	h := fnv.New32a()
-	h.Write([]byte(key))
-	return int(h.Sum32() & 0x7fffffff)
+/**
+Runs the reduce task, publishes its output once the controller allows it and then reports its
+completion, or its failure, to the controller.
+*/
+func (w *worker) runReduceTask(task GetReduceTaskResponse) error {
+	ref := TaskRef{JobId: task.JobId, TaskId: task.TaskId}
+	w.heartbeats.holdReduceTask(ref, true)
+	defer w.heartbeats.holdReduceTask(ref, false)
+
+	var outputFile *output.File
+	outputDir := jobOutputDir(task.JobId)
+	plugin, err := w.loadPlugin(task.JobId, task.PluginHash)
+	if err == nil {
+		err = os.MkdirAll(outputDir, os.ModePerm)
+	}
+	var outputFormat output.OutputFormat
+	if err == nil {
+		outputFormat, err = output.Lookup(task.OutputFormat)
+	}
+	var format kvFormat
+	if err == nil {
+		format, err = newKVFormat(task.IntermediateFormat, task.IntermediateCodec)
+	}
+	if err == nil {
+		outputFile, err = Reducer(
+			plugin.Reduce, outputFormat, task.OutputCodec, task.JobId, task.TaskId, task.MapAttempts, task.MapLocations, !task.NoSort,
+			w.sortBufferSize, format, outputDir,
+		)
+	}
+	var fetchErr *fetchError
+	if errors.As(err, &fetchErr) {
+		log.Printf(
+			"The attempt %d of reduce task %d of job %s is aborted, err: %v", task.Attempt, task.TaskId, task.JobId, err,
+		)
+		return w.reportFetchFailure(task.JobId, task.TaskId, task.Attempt, fetchErr)
+	}
+	if err != nil {
+		log.Printf(
+			"The attempt %d of reduce task %d of job %s failed, err: %v", task.Attempt, task.TaskId, task.JobId, err,
+		)
+		return w.reportTaskFailure(task.JobId, ReducePhase, task.TaskId, task.Attempt, err)
+	}
+	allowed, err := w.canCommitReduceTask(task.JobId, task.TaskId, task.Attempt)
+	if err != nil {
+		outputFile.Abort()
+		return err
+	}
+	committed, err := commitOutput(outputFile, allowed)
+	if err != nil {
+		log.Printf(
+			"The attempt %d of reduce task %d of job %s failed, err: %v", task.Attempt, task.TaskId, task.JobId, err,
+		)
+		return w.reportTaskFailure(task.JobId, ReducePhase, task.TaskId, task.Attempt, err)
+	}
+	if !committed {
+		return nil
+	}
+	accepted, err := w.updateReduceTaskWithCompletion(task.JobId, task.TaskId, task.Attempt)
+	if err == nil && !accepted {
+		log.Printf("The completion of the attempt %d of reduce task %d was not accepted", task.Attempt, task.TaskId)
+	}
+	return err
 }
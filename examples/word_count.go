@@ -28,8 +28,25 @@ func Map(filename, content string) []mr.KeyValue {
 }
 
 /**
-Returns the number of occurences for the key
+Returns the number of occurences for the key, the values are the counts emitted
+by Map or by Combine.
 */
 func Reduce(key string, values []string) string {
-	return strconv.Itoa(len(values))
+	count := 0
+	for _, value := range values {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			n = 1
+		}
+		count += n
+	}
+	return strconv.Itoa(count)
+}
+
+/**
+Sums the occurences of the key on the map side, so a single count per word
+and partition is shuffled.
+*/
+func Combine(key string, values []string) string {
+	return Reduce(key, values)
 }
@@ -1,11 +1,19 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"gomr.com/gomr/codec"
 	"gomr.com/gomr/distributed"
+	"gomr.com/gomr/input"
+	"gomr.com/gomr/output"
 	"gomr.com/gomr/utils"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
 	"time"
 )
 
@@ -14,38 +22,341 @@ type Command string
 const (
 	Controller Command = "controller"
 	Worker     Command = "worker"
+	Submit     Command = "submit"
+	Cat        Command = "cat"
 )
 
+const controllerShutdownGrace = 3 * time.Second
+
+/**
+Value of --resume which resumes every job in the job directories which did not end.
+*/
+const resumeAll = "all"
+
+/**
+Defines the flags configuring a job, shared by the controller and submit commands. The returned
+function builds the configuration once the flags are parsed.
+*/
+func jobFlags(flags *flag.FlagSet) func() distributed.JobConfig {
+	reducers := flags.Int("reducers", 10, "number of reduce tasks of the job")
+	splitSize := flags.Int64("split-size", input.DefaultSplitSize, "maximum bytes of input processed by a map task")
+	inputFormat := flags.String(
+		"input-format", "", "input format, one of "+strings.Join(input.FormatNames(), ", ")+
+			" (default the InputFormat of --plugin or "+input.DefaultFormat+")",
+	)
+	outputFormat := flags.String(
+		"output-format", output.DefaultFormat, "output format, one of "+strings.Join(output.FormatNames(), ", "),
+	)
+	noSort := flags.Bool(
+		"no-sort", false, "skip sorting, reduce tasks group their partition in memory and write it in no particular order, "+
+			"a partition larger than the --sort-buffer of the worker is still sorted on disk",
+	)
+	intermediateFormat := flags.String(
+		"intermediate-format", distributed.DefaultIntermediateFormat, "format of the map outputs, one of "+
+			strings.Join(distributed.IntermediateFormatNames(), ", ")+", json is slower but readable for debugging",
+	)
+	intermediateCodec := flags.String(
+		"intermediate-codec", codec.DefaultCodec, "codec compressing the map outputs, one of "+
+			strings.Join(codec.Names(), ", "),
+	)
+	outputCodec := flags.String(
+		"output-codec", codec.DefaultCodec, "codec compressing the output files, one of "+
+			strings.Join(codec.Names(), ", ")+", read gzip output with zcat and any with gomr cat",
+	)
+	partitioner := flags.String(
+		"partitioner", "", "\""+distributed.RangePartitioner+"\" for globally sorted output or \""+
+			distributed.HashPartitioner+"\" (default the Partition of the plugin or "+distributed.HashPartitioner+")",
+	)
+	sampleSize := flags.Int("sample-size", distributed.DefaultSampleSize, "keys sampled for the range partitioner")
+	mapTimeout := flags.Duration(
+		"map-timeout", distributed.DefaultTaskTimeout, "lease of a map task, it is reassigned once its worker "+
+			"sent no heartbeat for it for this long",
+	)
+	reduceTimeout := flags.Duration(
+		"reduce-timeout", distributed.DefaultTaskTimeout, "lease of a reduce task, it is reassigned once its worker "+
+			"sent no heartbeat for it for this long",
+	)
+	adaptiveTimeout := flags.Bool(
+		"adaptive-timeout", false, "start backup attempts of the tasks which ran three times longer than the "+
+			"90th percentile of the completed tasks, the leases stay fixed",
+	)
+	maxAttempts := flags.Int(
+		"max-attempts", distributed.DefaultMaxAttempts, "failed or timed out attempts after which a task is given up",
+	)
+	onFailure := flags.String(
+		"on-failure", distributed.FailJob, "what happens to a task which is given up: \""+distributed.FailJob+
+			"\" fails the job, \""+distributed.SkipTask+"\" skips the split or reduce partition of the task",
+	)
+	noSpeculation := flags.Bool(
+		"no-speculation", false, "never start backup attempts of tasks running much longer than their peers",
+	)
+	pluginFile := flags.String(
+		"plugin", "", "plugin .so file of the job, shipped to the workers which run it instead of their own plugin",
+	)
+	return func() distributed.JobConfig {
+		return distributed.JobConfig{
+			NumReduce:    *reducers,
+			Plugin:       readPlugin(*pluginFile),
+			SplitSize:    *splitSize,
+			InputFormat:  *inputFormat,
+			OutputFormat: *outputFormat,
+			OutputCodec:  *outputCodec,
+			NoSort:       *noSort,
+			Partitioner:  *partitioner,
+			SampleSize:   *sampleSize,
+
+			IntermediateFormat: *intermediateFormat,
+			IntermediateCodec:  *intermediateCodec,
+
+			MapTimeout:      *mapTimeout,
+			ReduceTimeout:   *reduceTimeout,
+			AdaptiveTimeout: *adaptiveTimeout,
+
+			MaxAttempts:   *maxAttempts,
+			FailurePolicy: *onFailure,
+			NoSpeculation: *noSpeculation,
+		}
+	}
+}
+
+/**
+Reads the plugin of a job, nil if no plugin is given.
+*/
+func readPlugin(path string) []byte {
+	if path == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Fatalf("Unable to read the plugin %v, err: %v", path, err)
+	}
+	return data
+}
+
+/**
+Makes the path absolute, the controller resolves it independent of the working directory of
+the command.
+*/
+func absPath(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		log.Fatalf("Unable to resolve the path %v, err: %v", path, err)
+	}
+	return abs
+}
+
 func processController() {
 	log.Print("Starting the Controller")
-	if len(os.Args) < 2 {
-		fmt.Fprintf(os.Stderr, "Usage: gomr controller input-files")
+	flags := flag.NewFlagSet("controller", flag.ExitOnError)
+	addr := flags.String(
+		"addr", "", "address to listen on, host:port or unix:/path (default $"+distributed.ControllerAddrEnv+
+			" or "+distributed.DefaultControllerAddr+")",
+	)
+	serve := flags.Bool(
+		"serve", false, "keep running once the jobs ended and accept further jobs submitted with gomr submit",
+	)
+	resume := flags.String(
+		"resume", "", "job directories /tmp/gomr/<jobid> of a crashed controller separated by commas, or \""+
+			resumeAll+"\" for every job in /tmp/gomr which did not end, continues their jobs",
+	)
+	workerTimeout := flags.Duration(
+		"worker-timeout", distributed.DefaultWorkerTimeout, "a worker which sent no heartbeat for this long is "+
+			"removed, the map tasks whose output it served run again",
+	)
+	jobConfig := jobFlags(flags)
+	flags.Parse(os.Args[2:])
+	if flags.NArg() < 1 && *resume == "" && !*serve {
+		fmt.Fprintf(os.Stderr, "Usage: gomr controller [flags] input-files|directories|globs\n")
+		fmt.Fprintf(os.Stderr, "       gomr controller [--addr address] [--serve] --resume job-dir[,job-dir...]|all\n")
+		fmt.Fprintf(os.Stderr, "       gomr controller [--addr address] --serve\n")
+		flags.PrintDefaults()
 		os.Exit(1)
 	}
-	c := distributed.MakerController(os.Args[2:], 10)
+
+	c := distributed.MakerController(distributed.ControllerConfig{
+		Addr:          distributed.ResolveAddr(*addr, distributed.DefaultControllerAddr),
+		Serve:         *serve,
+		WorkerTimeout: *workerTimeout,
+	})
+	if *resume == resumeAll {
+		jobIds, err := c.ResumeAll()
+		if err != nil {
+			log.Fatalf("Unable to resume the jobs, err: %v", err)
+		}
+		log.Printf("Resumed %d jobs which did not end", len(jobIds))
+	} else if *resume != "" {
+		for _, dir := range strings.Split(*resume, ",") {
+			if _, err := c.Resume(dir); err != nil {
+				log.Fatalf("Unable to resume the job in %v, err: %v", dir, err)
+			}
+		}
+	}
+	if flags.NArg() > 0 {
+		jobId, err := c.Submit(flags.Args(), jobConfig())
+		if err != nil {
+			log.Fatalf("Unable to start the job, err: %v", err)
+		}
+		log.Printf("Started the job %s, its output goes to %v", jobId, distributed.JobOutputDir(jobId))
+	}
+	waitForController(c)
+}
+
+/**
+Waits for the jobs of the controller to end and reports their outcome. A controller started
+with --serve keeps running.
+*/
+func waitForController(c *distributed.Controller) {
 	for !c.Done() {
 		log.Printf("Waiting for the Map Task to Complete")
 		time.Sleep(5 * time.Second)
 	}
-	time.Sleep(1 * time.Second)
+	//keep serving for a while so that the polling workers learn that the job is done
+	time.Sleep(controllerShutdownGrace)
+	failed := 0
+	for _, jobId := range c.JobIds() {
+		if summary := c.FailureSummary(jobId); summary != "" {
+			log.Printf("Tasks of the job %s with failed attempts:\n%s", jobId, summary)
+		}
+		if err := c.JobErr(jobId); err != nil {
+			log.Printf("Job %s failed: %v", jobId, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		log.Fatalf("%d of %d jobs failed", failed, len(c.JobIds()))
+	}
 	log.Printf("All tasks completed! Shutting down master")
 }
 
 func processWorker() {
 	log.Print("Starting the worker")
-	if len(os.Args) < 3 {
-		fmt.Fprintf(os.Stderr, "Usage: gomr worker xxx.so")
+	flags := flag.NewFlagSet("worker", flag.ExitOnError)
+	addr := flags.String(
+		"addr", "", "controller address to dial, host:port or unix:/path (default $"+
+			distributed.ControllerAddrEnv+" or "+distributed.DefaultWorkerDialAddr+")",
+	)
+	rpcDeadline := flags.Duration(
+		"rpc-deadline", distributed.DefaultRPCDeadline, "how long to retry an unreachable controller before giving up",
+	)
+	sortBuffer := flags.Int64(
+		"sort-buffer", distributed.DefaultSortBufferSize,
+		"bytes of records a map task buffers before spilling a sorted run to disk, their keys and values "+
+			"and a fixed overhead per record",
+	)
+	shuffleAddr := flags.String(
+		"shuffle-addr", distributed.DefaultShuffleAddr, "host:port the shuffle server serving the map outputs "+
+			"to the reducers listens on, without a host on all interfaces advertised with the host name",
+	)
+	flags.Parse(os.Args[2:])
+	if flags.NArg() > 1 {
+		fmt.Fprintf(os.Stderr, "Usage: gomr worker [flags] [xxx.so]\n")
+		flags.PrintDefaults()
 		os.Exit(1)
 	}
 
-	exec_file := os.Args[2]
+	//the plugin of the jobs submitted without one
+	var plugin *utils.Plugin
+	exec_file := flags.Arg(0)
+	if exec_file != "" {
+		plugin = utils.LoadPlugin(exec_file)
+	}
 
-	mapf, reducef := utils.LoadPlugin(exec_file)
-	distributed.Worker(mapf, reducef)
+	err := distributed.Worker(plugin, distributed.WorkerConfig{
+		Addr:        distributed.ResolveAddr(*addr, distributed.DefaultWorkerDialAddr),
+		RPCDeadline: *rpcDeadline,
+		SortBuffer:  *sortBuffer,
+		ShuffleAddr: *shuffleAddr,
+		PluginFile:  exec_file,
+	})
+	if err != nil {
+		log.Fatalf("Worker stopped with err: %v", err)
+	}
+	log.Print("Worker stopped")
+}
+
+/**
+Submits a job to a running controller and prints its id, with --wait also waits for the job
+and prints its output files.
+*/
+func processSubmit() {
+	flags := flag.NewFlagSet("submit", flag.ExitOnError)
+	addr := flags.String(
+		"addr", "", "controller address to dial, host:port or unix:/path (default $"+
+			distributed.ControllerAddrEnv+" or "+distributed.DefaultWorkerDialAddr+")",
+	)
+	rpcDeadline := flags.Duration(
+		"rpc-deadline", distributed.DefaultRPCDeadline, "how long to retry an unreachable controller before giving up",
+	)
+	wait := flags.Bool("wait", false, "wait for the job to end and print its output files as host:path")
+	jobConfig := jobFlags(flags)
+	flags.Parse(os.Args[2:])
+	if flags.NArg() < 1 {
+		fmt.Fprintf(os.Stderr, "Usage: gomr submit [flags] input-files|directories|globs\n")
+		flags.PrintDefaults()
+		os.Exit(1)
+	}
+
+	inputs := []string{}
+	for _, path := range flags.Args() {
+		inputs = append(inputs, absPath(path))
+	}
+	client := distributed.NewJobClient(distributed.ResolveAddr(*addr, distributed.DefaultWorkerDialAddr), *rpcDeadline)
+	jobId, err := client.Submit(inputs, jobConfig())
+	if err != nil {
+		log.Fatalf("Unable to submit the job, err: %v", err)
+	}
+	fmt.Println(jobId)
+	if !*wait {
+		return
+	}
+
+	status, err := client.Wait(jobId)
+	if err != nil {
+		log.Fatalf("Unable to wait for the job %s, err: %v", jobId, err)
+	}
+	if status.FailureSummary != "" {
+		log.Printf("Tasks of the job %s with failed attempts:\n%s", jobId, status.FailureSummary)
+	}
+	if status.State == distributed.JobFailed {
+		log.Fatalf("Job %s failed: %s", jobId, status.Error)
+	}
+	for _, output := range status.Outputs {
+		if output != "" {
+			fmt.Println(output)
+		}
+	}
+}
+
+/**
+Writes files to stdout, decompressed with the codec named in their header, e.g. the output
+files of a job written with --output-codec.
+*/
+func processCat() {
+	if len(os.Args) < 3 {
+		fmt.Fprintf(os.Stderr, "Usage: gomr cat files\n")
+		os.Exit(1)
+	}
+	for _, path := range os.Args[2:] {
+		file, err := os.Open(path)
+		if err != nil {
+			log.Fatalf("Unable to open %v, err: %v", path, err)
+		}
+		decompressed, err := codec.NewReader(file)
+		if err == nil {
+			_, err = io.Copy(os.Stdout, decompressed)
+		}
+		file.Close()
+		if err != nil {
+			log.Fatalf("Unable to read %v, err: %v", path, err)
+		}
+	}
 }
 
 func main() {
 	//simple.SimpleMapReduce()
+	if len(os.Args) < 2 {
+		log.Fatal("Wrong Command user gomr Controller, gomr Worker, gomr Submit or gomr Cat")
+	}
 	switch command := Command(os.Args[1]); command {
 	case Controller:
 		processController()
@@ -53,7 +364,13 @@ func main() {
 	case Worker:
 		processWorker()
 
+	case Submit:
+		processSubmit()
+
+	case Cat:
+		processCat()
+
 	default:
-		log.Fatal("Wrong Command user gomr Controller or gomr Worker")
+		log.Fatal("Wrong Command user gomr Controller, gomr Worker, gomr Submit or gomr Cat")
 	}
 }
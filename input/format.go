@@ -0,0 +1,258 @@
+package input
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/**
+Reads the (key, value) records of a split which are handed to the Map function.
+*/
+type RecordReader interface {
+	//returns the next record, io.EOF after the last one
+	Next() (string, string, error)
+	Close() error
+}
+
+/**
+Decides how the input files are split into map tasks and how a split is turned into records.
+*/
+type InputFormat interface {
+	Splits(files []string, splitSize int64) ([]Split, error)
+	Open(split Split) (RecordReader, error)
+}
+
+const (
+	Text      = "text"
+	Lines     = "lines"
+	WholeFile = "wholefile"
+	CSV       = "csv"
+	JSONLines = "jsonl"
+
+	DefaultFormat = Text
+)
+
+var formats = map[string]InputFormat{
+	Text:      textFormat{},
+	Lines:     lineFormat{},
+	WholeFile: wholeFileFormat{},
+	CSV:       csvFormat{},
+	JSONLines: jsonLinesFormat{},
+}
+
+/**
+Returns the built-in input format with the given name, the default format for "".
+*/
+func Lookup(name string) (InputFormat, error) {
+	if name == "" {
+		name = DefaultFormat
+	}
+	format, ok := formats[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown input format: %q, available: %s", name, strings.Join(FormatNames(), ", "))
+	}
+	return format, nil
+}
+
+func FormatNames() []string {
+	names := []string{}
+	for name := range formats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+/**
+"text": a single (filename, content of the split) record per split.
+*/
+type textFormat struct{}
+
+func (textFormat) Splits(files []string, splitSize int64) ([]Split, error) {
+	return ComputeSplits(files, splitSize)
+}
+
+func (textFormat) Open(split Split) (RecordReader, error) {
+	content, err := ReadSplit(split)
+	if err != nil {
+		return nil, err
+	}
+	return &singleRecordReader{key: split.Filename, value: content}, nil
+}
+
+/**
+"wholefile": a single (filename, content of the file) record per file, files are never split.
+*/
+type wholeFileFormat struct{}
+
+func (wholeFileFormat) Splits(files []string, splitSize int64) ([]Split, error) {
+	splits := []Split{}
+	for _, filename := range files {
+		info, err := os.Stat(filename)
+		if err != nil {
+			return nil, fmt.Errorf("cannot stat input file: %v, err: %w", filename, err)
+		}
+		splits = append(splits, Split{Filename: filename, Length: info.Size()})
+	}
+	return splits, nil
+}
+
+func (wholeFileFormat) Open(split Split) (RecordReader, error) {
+	content, err := ioutil.ReadFile(split.Filename)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read file: %v, err: %w", split.Filename, err)
+	}
+	return &singleRecordReader{key: split.Filename, value: string(content)}, nil
+}
+
+type singleRecordReader struct {
+	key   string
+	value string
+	read  bool
+}
+
+func (r *singleRecordReader) Next() (string, string, error) {
+	if r.read {
+		return "", "", io.EOF
+	}
+	r.read = true
+	return r.key, r.value, nil
+}
+
+func (r *singleRecordReader) Close() error {
+	return nil
+}
+
+/**
+"lines": a (byte offset, line) record per line, without the line terminator.
+*/
+type lineFormat struct{}
+
+func (lineFormat) Splits(files []string, splitSize int64) ([]Split, error) {
+	return ComputeSplits(files, splitSize)
+}
+
+func (lineFormat) Open(split Split) (RecordReader, error) {
+	r, err := OpenSplit(split)
+	if err != nil {
+		return nil, err
+	}
+	return &lineRecordReader{lines: r}, nil
+}
+
+type lineRecordReader struct {
+	lines *LineReader
+}
+
+func (r *lineRecordReader) Next() (string, string, error) {
+	offset, line, err := r.lines.ReadLine()
+	if err != nil {
+		return "", "", err
+	}
+	return strconv.FormatInt(offset, 10), trimLineEnd(line), nil
+}
+
+func (r *lineRecordReader) Close() error {
+	return r.lines.Close()
+}
+
+func trimLineEnd(line string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+}
+
+/**
+"csv": a (byte offset, fields) record per row. The fields are passed to the Map function as
+a json array of strings. Rows are read line by line, quoted fields spanning lines are not supported.
+*/
+type csvFormat struct{}
+
+func (csvFormat) Splits(files []string, splitSize int64) ([]Split, error) {
+	return ComputeSplits(files, splitSize)
+}
+
+func (csvFormat) Open(split Split) (RecordReader, error) {
+	r, err := OpenSplit(split)
+	if err != nil {
+		return nil, err
+	}
+	return &csvRecordReader{lines: r}, nil
+}
+
+type csvRecordReader struct {
+	lines *LineReader
+}
+
+func (r *csvRecordReader) Next() (string, string, error) {
+	for {
+		offset, line, err := r.lines.ReadLine()
+		if err != nil {
+			return "", "", err
+		}
+		line = trimLineEnd(line)
+		if line == "" {
+			continue
+		}
+		fields, err := csv.NewReader(strings.NewReader(line)).Read()
+		if err != nil {
+			return "", "", fmt.Errorf("invalid csv row at offset %d of %v, err: %w", offset, r.lines.file.Name(), err)
+		}
+		value, err := json.Marshal(fields)
+		if err != nil {
+			return "", "", err
+		}
+		return strconv.FormatInt(offset, 10), string(value), nil
+	}
+}
+
+func (r *csvRecordReader) Close() error {
+	return r.lines.Close()
+}
+
+/**
+"jsonl": a (byte offset, json document) record per non empty line.
+*/
+type jsonLinesFormat struct{}
+
+func (jsonLinesFormat) Splits(files []string, splitSize int64) ([]Split, error) {
+	return ComputeSplits(files, splitSize)
+}
+
+func (jsonLinesFormat) Open(split Split) (RecordReader, error) {
+	r, err := OpenSplit(split)
+	if err != nil {
+		return nil, err
+	}
+	return &jsonLinesRecordReader{lines: r}, nil
+}
+
+type jsonLinesRecordReader struct {
+	lines *LineReader
+}
+
+func (r *jsonLinesRecordReader) Next() (string, string, error) {
+	for {
+		offset, line, err := r.lines.ReadLine()
+		if err != nil {
+			return "", "", err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if !json.Valid([]byte(line)) {
+			return "", "", fmt.Errorf("invalid json line at offset %d of %v", offset, r.lines.file.Name())
+		}
+		return strconv.FormatInt(offset, 10), line, nil
+	}
+}
+
+func (r *jsonLinesRecordReader) Close() error {
+	return r.lines.Close()
+}
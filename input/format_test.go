@@ -0,0 +1,110 @@
+package input
+
+import (
+	"io"
+	"reflect"
+	"testing"
+)
+
+/**
+Reads the records of all the splits of the file in the format.
+*/
+func readTestRecords(t *testing.T, name string, filename string, splitSize int64) ([][2]string, error) {
+	t.Helper()
+	format, err := Lookup(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	splits, err := format.Splits([]string{filename}, splitSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := [][2]string{}
+	for _, split := range splits {
+		r, err := format.Open(split)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for {
+			key, value, err := r.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				r.Close()
+				return nil, err
+			}
+			records = append(records, [2]string{key, value})
+		}
+		r.Close()
+	}
+	return records, nil
+}
+
+func TestRecordFormats(t *testing.T) {
+	tests := []struct {
+		format  string
+		content string
+		records [][2]string
+	}{
+		{Lines, "a\r\nbb\n\nc", [][2]string{{"0", "a"}, {"3", "bb"}, {"6", ""}, {"7", "c"}}},
+		{CSV, "x,\"y,z\"\r\n\n1,2\n", [][2]string{{"0", `["x","y,z"]`}, {"10", `["1","2"]`}}},
+		{CSV, "a,,\"\"\"q\"\"\"", [][2]string{{"0", `["a","","\"q\""]`}}},
+		{JSONLines, "{\"a\":1}\n  \n [2] \n", [][2]string{{"0", `{"a":1}`}, {"11", "[2]"}}},
+		{JSONLines, "", [][2]string{}},
+	}
+	for _, test := range tests {
+		filename := writeTestFile(t, test.content)
+		//every split size reads every record once
+		for size := int64(1); size <= int64(len(test.content))+1; size++ {
+			records, err := readTestRecords(t, test.format, filename, size)
+			if err != nil {
+				t.Fatalf("%s %q: %v", test.format, test.content, err)
+			}
+			if !reflect.DeepEqual(records, test.records) {
+				t.Errorf("%s %q in splits of %d: read %q, expected %q", test.format, test.content, size, records, test.records)
+			}
+		}
+	}
+}
+
+func TestFileRecordFormats(t *testing.T) {
+	content := "aa\nbbb\nc\ndd"
+	filename := writeTestFile(t, content)
+	for _, format := range []string{"", Text, WholeFile} {
+		records, err := readTestRecords(t, format, filename, int64(len(content)+1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) != 1 || records[0] != [2]string{filename, content} {
+			t.Errorf("%q read %q", format, records)
+		}
+	}
+	//a file is never split
+	records, err := readTestRecords(t, WholeFile, filename, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0][1] != content {
+		t.Errorf("read %q in splits of 2", records)
+	}
+}
+
+func TestInvalidRecords(t *testing.T) {
+	tests := []struct {
+		format  string
+		content string
+	}{
+		{CSV, "a,b\nc,\"d\n"},
+		{JSONLines, "{}\n{\"a\":\n"},
+		{JSONLines, "not json\n"},
+	}
+	for _, test := range tests {
+		if _, err := readTestRecords(t, test.format, writeTestFile(t, test.content), 1<<20); err == nil {
+			t.Errorf("%s read the invalid records %q", test.format, test.content)
+		}
+	}
+	if _, err := Lookup("xml"); err == nil {
+		t.Error("looked up an unknown format")
+	}
+}
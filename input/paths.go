@@ -0,0 +1,85 @@
+package input
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+/**
+Expands the input arguments into the list of input files.
+
+Every argument is either a file, a directory whose files are added recursively, or a glob
+pattern (see filepath.Match) of files and directories. Files and directories whose name
+starts with "." or "_" are skipped inside of directories.
+*/
+func ExpandPaths(args []string) ([]string, error) {
+	files := []string{}
+	seen := make(map[string]bool)
+	add := func(path string) {
+		if !seen[path] {
+			seen[path] = true
+			files = append(files, path)
+		}
+	}
+
+	for _, arg := range args {
+		matches := []string{arg}
+		if strings.ContainsAny(arg, "*?[") {
+			var err error
+			matches, err = filepath.Glob(arg)
+			if err != nil {
+				return nil, fmt.Errorf("invalid input pattern: %v, err: %w", arg, err)
+			}
+			if len(matches) == 0 {
+				return nil, fmt.Errorf("no input files match: %v", arg)
+			}
+		}
+
+		for _, match := range matches {
+			info, err := os.Stat(match)
+			if err != nil {
+				return nil, fmt.Errorf("cannot stat input: %v, err: %w", match, err)
+			}
+			if !info.IsDir() {
+				add(match)
+				continue
+			}
+			dirFiles, err := listDir(match)
+			if err != nil {
+				return nil, err
+			}
+			for _, file := range dirFiles {
+				add(file)
+			}
+		}
+	}
+	return files, nil
+}
+
+func listDir(dir string) ([]string, error) {
+	files := []string{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name := info.Name()
+		if path != dir && (strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_")) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.Mode().IsRegular() {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot list input directory: %v, err: %w", dir, err)
+	}
+	sort.Strings(files)
+	return files, nil
+}
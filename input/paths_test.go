@@ -0,0 +1,59 @@
+package input
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestExpandPaths(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{
+		"d/a.txt", "d/sub/b.txt", "d/.hidden", "d/_SUCCESS", "d/_tmp/c.txt", "d/.git/x", "e.txt", "f.csv",
+	} {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := func(names ...string) []string {
+		paths := []string{}
+		for _, name := range names {
+			paths = append(paths, filepath.Join(root, name))
+		}
+		return paths
+	}
+
+	tests := []struct {
+		args  []string
+		files []string
+	}{
+		{path("e.txt"), path("e.txt")},
+		{path("d"), path("d/a.txt", "d/sub/b.txt")},               //hidden files are skipped inside of directories
+		{path("d/.hidden"), path("d/.hidden")},                    //but not when named
+		{path("f.csv", "e.txt", "f.csv"), path("f.csv", "e.txt")}, //in order, without duplicates
+		{path("*.txt"), path("e.txt")},
+		{path("*"), path("d/a.txt", "d/sub/b.txt", "e.txt", "f.csv")},
+		{path("d/*/*.txt", "d"), path("d/_tmp/c.txt", "d/sub/b.txt", "d/a.txt")},
+	}
+	for _, test := range tests {
+		files, err := ExpandPaths(test.args)
+		if err != nil {
+			t.Fatalf("%v: %v", test.args, err)
+		}
+		if !reflect.DeepEqual(files, test.files) {
+			t.Errorf("%v expanded to %v, expected %v", test.args, files, test.files)
+		}
+	}
+
+	for _, args := range [][]string{path("missing.txt"), path("*.json"), path("[")} {
+		if files, err := ExpandPaths(args); err == nil {
+			t.Errorf("%v expanded to %v", args, files)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package input
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+/**
+Default size of an input split, 64MB.
+*/
+const DefaultSplitSize int64 = 64 << 20
+
+/**
+A byte range of an input file processed by a single map task.
+
+Splits are cut at fixed byte offsets. A line belongs to the split in which it starts: the
+reader of a split skips the partial line at its beginning and finishes the line running
+over its end.
+*/
+type Split struct {
+	Filename string
+	Offset   int64
+	Length   int64
+}
+
+func (s Split) String() string {
+	return fmt.Sprintf("%s[%d:%d]", s.Filename, s.Offset, s.Offset+s.Length)
+}
+
+/**
+Breaks the files into splits of at most splitSize bytes.
+An empty file still produces a single empty split.
+*/
+func ComputeSplits(files []string, splitSize int64) ([]Split, error) {
+	if splitSize <= 0 {
+		splitSize = DefaultSplitSize
+	}
+	splits := []Split{}
+	for _, filename := range files {
+		info, err := os.Stat(filename)
+		if err != nil {
+			return nil, fmt.Errorf("cannot stat input file: %v, err: %w", filename, err)
+		}
+		size := info.Size()
+		if size == 0 {
+			splits = append(splits, Split{Filename: filename})
+			continue
+		}
+		for offset := int64(0); offset < size; offset += splitSize {
+			length := splitSize
+			if offset+length > size {
+				length = size - offset
+			}
+			splits = append(splits, Split{Filename: filename, Offset: offset, Length: length})
+		}
+	}
+	return splits, nil
+}
+
+/**
+Reader of the lines of a split. Every line is returned with its byte offset in the file.
+*/
+type LineReader struct {
+	file   *os.File
+	reader *bufio.Reader
+	pos    int64 //offset of the next line
+	end    int64
+}
+
+/**
+Opens the split and positions the reader on the first line starting inside of it.
+*/
+func OpenSplit(split Split) (*LineReader, error) {
+	file, err := os.Open(split.Filename)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open file: %v, err: %w", split.Filename, err)
+	}
+	r := &LineReader{file: file, pos: split.Offset, end: split.Offset + split.Length}
+	if split.Offset == 0 {
+		r.reader = bufio.NewReader(file)
+		return r, nil
+	}
+
+	//start one byte early, if it is a newline the split starts on a line boundary
+	if _, err := file.Seek(split.Offset-1, io.SeekStart); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("cannot seek file: %v, err: %w", split.Filename, err)
+	}
+	r.reader = bufio.NewReader(file)
+	skipped, err := r.reader.ReadString('\n')
+	if err != nil && err != io.EOF {
+		file.Close()
+		return nil, fmt.Errorf("cannot read file: %v, err: %w", split.Filename, err)
+	}
+	r.pos = split.Offset - 1 + int64(len(skipped))
+	return r, nil
+}
+
+/**
+Returns the next line including its trailing newline and the offset it starts at,
+io.EOF once no more lines start inside the split.
+*/
+func (r *LineReader) ReadLine() (int64, string, error) {
+	if r.pos >= r.end {
+		return 0, "", io.EOF
+	}
+	line, err := r.reader.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return 0, "", fmt.Errorf("cannot read file: %v, err: %w", r.file.Name(), err)
+	}
+	if len(line) == 0 {
+		return 0, "", io.EOF
+	}
+	offset := r.pos
+	r.pos += int64(len(line))
+	return offset, line, nil
+}
+
+func (r *LineReader) Close() error {
+	return r.file.Close()
+}
+
+/**
+Reads the content of the lines starting inside the split.
+*/
+func ReadSplit(split Split) (string, error) {
+	r, err := OpenSplit(split)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	var content strings.Builder
+	for {
+		_, line, err := r.ReadLine()
+		if err == io.EOF {
+			return content.String(), nil
+		}
+		if err != nil {
+			return "", err
+		}
+		content.WriteString(line)
+	}
+}
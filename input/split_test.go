@@ -0,0 +1,101 @@
+package input
+
+import (
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeTestFile(t *testing.T, content string) string {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "input.txt")
+	if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestSplitBoundaries(t *testing.T) {
+	//"aa\n" is at 0, "bbb\n" at 3, "c\n" at 7, "dd" at 9
+	filename := writeTestFile(t, "aa\nbbb\nc\ndd")
+	tests := []struct {
+		offset  int64
+		length  int64
+		content string
+	}{
+		{0, 2, "aa\n"},            //ends just before the newline
+		{0, 3, "aa\n"},            //ends just after the newline
+		{2, 1, ""},                //only the newline of a line started before
+		{2, 2, "bbb\n"},           //starts on the newline
+		{3, 1, "bbb\n"},           //starts just after the newline
+		{3, 4, "bbb\n"},           //ends on the newline
+		{4, 3, ""},                //inside of a line
+		{6, 1, ""},                //only a newline
+		{6, 2, "c\n"},             //starts on the newline
+		{7, 4, "c\ndd"},           //up to the end of the file without a newline
+		{8, 3, "dd"},              //starts on the last newline
+		{9, 2, "dd"},              //starts just after the last newline
+		{10, 1, ""},               //inside of the last line
+		{0, 11, "aa\nbbb\nc\ndd"}, //the whole file
+	}
+	for _, test := range tests {
+		split := Split{Filename: filename, Offset: test.offset, Length: test.length}
+		content, err := ReadSplit(split)
+		if err != nil {
+			t.Fatalf("%v: %v", split, err)
+		}
+		if content != test.content {
+			t.Errorf("%v: read %q, expected %q", split, content, test.content)
+		}
+	}
+}
+
+func TestSplitsCoverEveryLineOnce(t *testing.T) {
+	for _, content := range []string{"aa\nbbb\nc\ndd", "aa\nbbb\nc\ndd\n", "\n\na\n\n", "x"} {
+		filename := writeTestFile(t, content)
+		for size := int64(1); size <= int64(len(content))+1; size++ {
+			splits, err := ComputeSplits([]string{filename}, size)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var read strings.Builder
+			for _, split := range splits {
+				part, err := ReadSplit(split)
+				if err != nil {
+					t.Fatalf("%v: %v", split, err)
+				}
+				read.WriteString(part)
+			}
+			if read.String() != content {
+				t.Errorf("splits of size %d of %q read %q", size, content, read.String())
+			}
+		}
+	}
+}
+
+func TestLineOffsets(t *testing.T) {
+	filename := writeTestFile(t, "aa\nbbb\nc\ndd")
+	r, err := OpenSplit(Split{Filename: filename, Offset: 2, Length: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	expected := []struct {
+		offset int64
+		line   string
+	}{{3, "bbb\n"}, {7, "c\n"}, {9, "dd"}}
+	for _, e := range expected {
+		offset, line, err := r.ReadLine()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if offset != e.offset || line != e.line {
+			t.Fatalf("read %q at %d, expected %q at %d", line, offset, e.line, e.offset)
+		}
+	}
+	if _, _, err := r.ReadLine(); err != io.EOF {
+		t.Fatalf("expected io.EOF, got %v", err)
+	}
+}
@@ -0,0 +1,53 @@
+package mr
+
+import (
+	"hash/fnv"
+	"sort"
+)
+
+/**
+Default partitioner, spreads the keys over the reduce tasks by their FNV-32a hash.
+*/
+func HashPartition(key string, nReduce int) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32()&0x7fffffff) % nReduce
+}
+
+/**
+Partitions the keys by ranges, reduce task i gets the keys k with
+Boundaries[i-1] <= k < Boundaries[i]. With nReduce-1 boundaries the concatenated
+output of the reduce tasks 0..nReduce-1 is globally sorted.
+*/
+type RangePartitioner struct {
+	Boundaries []string
+}
+
+func (r RangePartitioner) Partition(key string, nReduce int) int {
+	partition := sort.Search(len(r.Boundaries), func(i int) bool { return key < r.Boundaries[i] })
+	if partition >= nReduce {
+		partition = nReduce - 1
+	}
+	return partition
+}
+
+/**
+Picks the nReduce-1 boundaries splitting the sampled keys into ranges of equal size.
+Duplicate boundaries are dropped, so frequent keys may leave some reduce tasks empty.
+*/
+func SampleBoundaries(sample []string, nReduce int) []string {
+	if len(sample) == 0 || nReduce <= 1 {
+		return []string{}
+	}
+	keys := append([]string{}, sample...)
+	sort.Strings(keys)
+	boundaries := []string{}
+	for i := 1; i < nReduce; i++ {
+		boundary := keys[i*len(keys)/nReduce]
+		if len(boundaries) > 0 && boundaries[len(boundaries)-1] == boundary {
+			continue
+		}
+		boundaries = append(boundaries, boundary)
+	}
+	return boundaries
+}
@@ -0,0 +1,98 @@
+package mr
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestHashPartition(t *testing.T) {
+	for _, nReduce := range []int{1, 2, 7} {
+		counts := make([]int, nReduce)
+		for i := 0; i < 1000; i++ {
+			key := fmt.Sprintf("key-%d", i)
+			partition := HashPartition(key, nReduce)
+			if partition < 0 || partition >= nReduce {
+				t.Fatalf("%q is in partition %d of %d", key, partition, nReduce)
+			}
+			if again := HashPartition(key, nReduce); again != partition {
+				t.Fatalf("%q is in partition %d and %d", key, partition, again)
+			}
+			counts[partition]++
+		}
+		for partition, count := range counts {
+			if count < 1000/nReduce/2 {
+				t.Errorf("partition %d of %d got %d of 1000 keys", partition, nReduce, count)
+			}
+		}
+	}
+}
+
+func TestRangePartition(t *testing.T) {
+	tests := []struct {
+		boundaries []string
+		nReduce    int
+		key        string
+		partition  int
+	}{
+		{[]string{"g", "p"}, 3, "", 0},
+		{[]string{"g", "p"}, 3, "a", 0},
+		{[]string{"g", "p"}, 3, "fzz", 0},
+		{[]string{"g", "p"}, 3, "g", 1}, //a boundary starts its partition
+		{[]string{"g", "p"}, 3, "o", 1},
+		{[]string{"g", "p"}, 3, "p", 2},
+		{[]string{"g", "p"}, 3, "zzz", 2},
+		{[]string{"g", "p"}, 2, "z", 1}, //more boundaries than partitions
+		{[]string{}, 3, "z", 0},
+	}
+	for _, test := range tests {
+		partitioner := RangePartitioner{Boundaries: test.boundaries}
+		if partition := partitioner.Partition(test.key, test.nReduce); partition != test.partition {
+			t.Errorf("%v of %d: %q is in partition %d, expected %d", test.boundaries, test.nReduce, test.key, partition, test.partition)
+		}
+	}
+}
+
+func TestSampleBoundaries(t *testing.T) {
+	tests := []struct {
+		sample     []string
+		nReduce    int
+		boundaries []string
+	}{
+		{[]string{"j", "i", "h", "g", "f", "e", "d", "c", "b", "a"}, 3, []string{"d", "g"}},
+		{[]string{"a", "b", "c", "d"}, 4, []string{"b", "c", "d"}},
+		{[]string{"a", "a", "a", "a", "a", "c"}, 3, []string{"a"}}, //duplicates are dropped
+		{[]string{"a", "a", "a"}, 3, []string{"a"}},
+		{[]string{"a", "b"}, 1, []string{}},
+		{[]string{}, 3, []string{}},
+	}
+	for _, test := range tests {
+		if boundaries := SampleBoundaries(test.sample, test.nReduce); !reflect.DeepEqual(boundaries, test.boundaries) {
+			t.Errorf("%v of %d: boundaries %q, expected %q", test.sample, test.nReduce, boundaries, test.boundaries)
+		}
+	}
+}
+
+func TestRangePartitionsAreSorted(t *testing.T) {
+	keys := []string{}
+	for i := 0; i < 500; i++ {
+		keys = append(keys, fmt.Sprintf("%x", i*7919%1000))
+	}
+	const nReduce = 4
+	partitioner := RangePartitioner{Boundaries: SampleBoundaries(keys[:100], nReduce)}
+	partitions := make([][]string, nReduce)
+	for _, key := range keys {
+		partition := partitioner.Partition(key, nReduce)
+		partitions[partition] = append(partitions[partition], key)
+	}
+	//the sorted partitions concatenated are the sorted keys
+	concatenated := []string{}
+	for _, partition := range partitions {
+		sort.Strings(partition)
+		concatenated = append(concatenated, partition...)
+	}
+	if !sort.StringsAreSorted(concatenated) {
+		t.Fatal("the concatenated partitions are not sorted")
+	}
+}
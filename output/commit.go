@@ -0,0 +1,97 @@
+package output
+
+import (
+	"fmt"
+	"gomr.com/gomr/codec"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+/**
+An output file written under a temporary name in the output directory, compressed with its
+codec.
+
+Nothing is visible under the final name until Commit, which atomically renames the temporary
+file over it. Abort discards the temporary file, e.g. when the controller did not accept
+the attempt that wrote it.
+*/
+type File struct {
+	RecordWriter
+	compressed io.WriteCloser
+	file       *os.File
+	finalPath  string
+	closed     bool
+}
+
+/**
+Creates a temporary file for the final file name in dir, compressed with the named codec, see
+codec.NewWriter. Read it back through codec.NewReader.
+*/
+func Create(dir string, name string, format OutputFormat, codecName string) (*File, error) {
+	file, err := ioutil.TempFile(dir, "."+name+".tmp-")
+	if err != nil {
+		return nil, fmt.Errorf("cannot create temporary output file for %v in %v, err: %w", name, dir, err)
+	}
+	compressed, err := codec.NewWriter(file, codecName)
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, fmt.Errorf("cannot compress the output file %v, err: %w", name, err)
+	}
+	return &File{
+		RecordWriter: format.NewWriter(compressed),
+		compressed:   compressed,
+		file:         file,
+		finalPath:    filepath.Join(dir, name),
+	}, nil
+}
+
+func (f *File) Name() string {
+	return f.finalPath
+}
+
+/**
+Flushes, syncs and closes the temporary file, it can be committed or aborted afterwards.
+*/
+func (f *File) Close() error {
+	if f.closed {
+		return nil
+	}
+	f.closed = true
+	if err := f.Flush(); err != nil {
+		f.file.Close()
+		return err
+	}
+	if err := f.compressed.Close(); err != nil {
+		f.file.Close()
+		return err
+	}
+	if err := f.file.Sync(); err != nil {
+		f.file.Close()
+		return err
+	}
+	return f.file.Close()
+}
+
+/**
+Publishes the file under its final name.
+*/
+func (f *File) Commit() error {
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.file.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(f.file.Name(), f.finalPath)
+}
+
+/**
+Discards the temporary file.
+*/
+func (f *File) Abort() error {
+	f.Close()
+	return os.Remove(f.file.Name())
+}
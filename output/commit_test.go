@@ -0,0 +1,116 @@
+package output
+
+import (
+	"gomr.com/gomr/codec"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func listDir(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func createTestFile(t *testing.T, dir string, codecName string) *File {
+	t.Helper()
+	format, _ := Lookup(Text)
+	file, err := Create(dir, "part-0", format, codecName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := file.Write("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestCommitPublishesTheFile(t *testing.T) {
+	for _, codecName := range []string{"", codec.Gzip, codec.Flate} {
+		dir := t.TempDir()
+		file := createTestFile(t, dir, codecName)
+		if file.Name() != filepath.Join(dir, "part-0") {
+			t.Fatalf("the final name is %v", file.Name())
+		}
+		//nothing is visible under the final name before the commit
+		if names := listDir(t, dir); len(names) != 1 || names[0] == "part-0" {
+			t.Fatalf("%q: the directory holds %v before the commit", codecName, names)
+		}
+		if err := file.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		if names := listDir(t, dir); len(names) != 1 || names[0] != "part-0" {
+			t.Fatalf("%q: the directory holds %v after the commit", codecName, names)
+		}
+		if info, err := os.Stat(file.Name()); err != nil || info.Mode().Perm() != 0644 {
+			t.Fatalf("%q: the committed file has the mode %v, err: %v", codecName, info.Mode(), err)
+		}
+
+		compressed, err := os.Open(file.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader, err := codec.NewReader(compressed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := ioutil.ReadAll(reader)
+		reader.Close()
+		compressed.Close()
+		if err != nil || string(content) != "a 1\n" {
+			t.Fatalf("%q: read %q, err: %v", codecName, content, err)
+		}
+	}
+}
+
+func TestCommitReplacesTheFile(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "part-0"), []byte("partial output of an earlier attempt"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	file := createTestFile(t, dir, "")
+	if err := file.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(dir, "part-0"))
+	if err != nil || string(content) != "a 1\n" {
+		t.Fatalf("read %q, err: %v", content, err)
+	}
+}
+
+func TestAbortDiscardsTheFile(t *testing.T) {
+	dir := t.TempDir()
+	file := createTestFile(t, dir, codec.Gzip)
+	if err := file.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	if names := listDir(t, dir); len(names) != 0 {
+		t.Fatalf("the directory holds %v after the abort", names)
+	}
+
+	//an aborted file can be closed again, as a deferred Close does
+	file = createTestFile(t, dir, "")
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := file.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if names := listDir(t, dir); len(names) != 0 {
+		t.Fatalf("the directory holds %v after the abort", names)
+	}
+}
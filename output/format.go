@@ -0,0 +1,245 @@
+package output
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+/**
+Writes the (key, reduce output) records of a reduce task.
+*/
+type RecordWriter interface {
+	Write(key string, value string) error
+	//flushes the buffered records, the underlying writer stays open
+	Flush() error
+}
+
+/**
+Decides how the records of a reduce task are encoded in its output file.
+*/
+type OutputFormat interface {
+	NewWriter(w io.Writer) RecordWriter
+}
+
+const (
+	Text      = "text"
+	TSV       = "tsv"
+	JSONLines = "jsonl"
+	Binary    = "binary"
+
+	DefaultFormat = Text
+)
+
+var formats = map[string]OutputFormat{
+	Text:      textFormat{},
+	TSV:       tsvFormat{},
+	JSONLines: jsonLinesFormat{},
+	Binary:    binaryFormat{},
+}
+
+/**
+Returns the built-in output format with the given name, the default format for "".
+*/
+func Lookup(name string) (OutputFormat, error) {
+	if name == "" {
+		name = DefaultFormat
+	}
+	format, ok := formats[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown output format: %q, available: %s", name, strings.Join(FormatNames(), ", "))
+	}
+	return format, nil
+}
+
+func FormatNames() []string {
+	names := []string{}
+	for name := range formats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+/**
+"text": "key value" lines.
+*/
+type textFormat struct{}
+
+func (textFormat) NewWriter(w io.Writer) RecordWriter {
+	return &textWriter{w: bufio.NewWriter(w)}
+}
+
+type textWriter struct {
+	w *bufio.Writer
+}
+
+func (t *textWriter) Write(key string, value string) error {
+	_, err := fmt.Fprintf(t.w, "%v %v\n", key, value)
+	return err
+}
+
+func (t *textWriter) Flush() error {
+	return t.w.Flush()
+}
+
+/**
+"tsv": "key<TAB>value" lines. Backslashes, tabs and newlines in the fields are escaped as
+\\, \t and \n.
+*/
+type tsvFormat struct{}
+
+var tsvEscaper = strings.NewReplacer("\\", "\\\\", "\t", "\\t", "\n", "\\n", "\r", "\\r")
+
+func (tsvFormat) NewWriter(w io.Writer) RecordWriter {
+	return &tsvWriter{w: bufio.NewWriter(w)}
+}
+
+type tsvWriter struct {
+	w *bufio.Writer
+}
+
+func (t *tsvWriter) Write(key string, value string) error {
+	_, err := fmt.Fprintf(t.w, "%s\t%s\n", tsvEscaper.Replace(key), tsvEscaper.Replace(value))
+	return err
+}
+
+func (t *tsvWriter) Flush() error {
+	return t.w.Flush()
+}
+
+/**
+"jsonl": a {"key": ..., "value": ...} document per line.
+*/
+type jsonLinesFormat struct{}
+
+type jsonRecord struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+func (jsonLinesFormat) NewWriter(w io.Writer) RecordWriter {
+	buffered := bufio.NewWriter(w)
+	return &jsonLinesWriter{w: buffered, encoder: json.NewEncoder(buffered)}
+}
+
+type jsonLinesWriter struct {
+	w       *bufio.Writer
+	encoder *json.Encoder
+}
+
+func (j *jsonLinesWriter) Write(key string, value string) error {
+	return j.encoder.Encode(jsonRecord{Key: key, Value: value})
+}
+
+func (j *jsonLinesWriter) Flush() error {
+	return j.w.Flush()
+}
+
+/**
+"binary": the BinaryMagic header followed by the records in key order (unless the job runs
+with --no-sort), every record is a uvarint length prefixed key followed by a uvarint length
+prefixed value.
+Read it back with NewBinaryReader.
+*/
+type binaryFormat struct{}
+
+const BinaryMagic = "GMRO1\n"
+
+func (binaryFormat) NewWriter(w io.Writer) RecordWriter {
+	return &binaryWriter{w: bufio.NewWriter(w)}
+}
+
+type binaryWriter struct {
+	w             *bufio.Writer
+	headerWritten bool
+}
+
+func (b *binaryWriter) writeHeader() error {
+	if b.headerWritten {
+		return nil
+	}
+	b.headerWritten = true
+	_, err := b.w.WriteString(BinaryMagic)
+	return err
+}
+
+func (b *binaryWriter) writeField(field string) error {
+	var length [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(length[:], uint64(len(field)))
+	if _, err := b.w.Write(length[:n]); err != nil {
+		return err
+	}
+	_, err := b.w.WriteString(field)
+	return err
+}
+
+func (b *binaryWriter) Write(key string, value string) error {
+	if err := b.writeHeader(); err != nil {
+		return err
+	}
+	if err := b.writeField(key); err != nil {
+		return err
+	}
+	return b.writeField(value)
+}
+
+func (b *binaryWriter) Flush() error {
+	if err := b.writeHeader(); err != nil {
+		return err
+	}
+	return b.w.Flush()
+}
+
+/**
+Reads the records of a "binary" output file.
+*/
+type BinaryReader struct {
+	r *bufio.Reader
+}
+
+func NewBinaryReader(r io.Reader) (*BinaryReader, error) {
+	reader := bufio.NewReader(r)
+	magic := make([]byte, len(BinaryMagic))
+	if _, err := io.ReadFull(reader, magic); err != nil {
+		return nil, fmt.Errorf("cannot read the binary output header, err: %w", err)
+	}
+	if string(magic) != BinaryMagic {
+		return nil, fmt.Errorf("not a binary output file")
+	}
+	return &BinaryReader{r: reader}, nil
+}
+
+func (b *BinaryReader) readField() (string, error) {
+	length, err := binary.ReadUvarint(b.r)
+	if err != nil {
+		return "", err
+	}
+	field := make([]byte, length)
+	if _, err := io.ReadFull(b.r, field); err != nil {
+		return "", err
+	}
+	return string(field), nil
+}
+
+/**
+Returns the next record, io.EOF after the last one.
+*/
+func (b *BinaryReader) Next() (string, string, error) {
+	key, err := b.readField()
+	if err != nil {
+		return "", "", err
+	}
+	value, err := b.readField()
+	if err == io.EOF {
+		return "", "", io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return "", "", err
+	}
+	return key, value, nil
+}
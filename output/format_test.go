@@ -0,0 +1,102 @@
+package output
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+var testRecords = [][2]string{{"a", "1"}, {"tab\tkey", "new\nline"}, {"", ""}, {"back\\slash", "é"}}
+
+func writeTestRecords(t *testing.T, name string) []byte {
+	t.Helper()
+	format, err := Lookup(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	writer := format.NewWriter(&b)
+	for _, record := range testRecords {
+		if err := writer.Write(record[0], record[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestTextFormats(t *testing.T) {
+	tests := []struct {
+		format string
+		output string
+	}{
+		{"", "a 1\ntab\tkey new\nline\n \nback\\slash é\n"},
+		{Text, "a 1\ntab\tkey new\nline\n \nback\\slash é\n"},
+		{TSV, "a\t1\ntab\\tkey\tnew\\nline\n\t\nback\\\\slash\té\n"},
+		{JSONLines, `{"key":"a","value":"1"}` + "\n" + `{"key":"tab\tkey","value":"new\nline"}` + "\n" +
+			`{"key":"","value":""}` + "\n" + `{"key":"back\\slash","value":"é"}` + "\n"},
+	}
+	for _, test := range tests {
+		if output := string(writeTestRecords(t, test.format)); output != test.output {
+			t.Errorf("%q wrote %q, expected %q", test.format, output, test.output)
+		}
+	}
+}
+
+func TestBinaryFormat(t *testing.T) {
+	output := writeTestRecords(t, Binary)
+	reader, err := NewBinaryReader(bytes.NewReader(output))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, record := range testRecords {
+		key, value, err := reader.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key != record[0] || value != record[1] {
+			t.Fatalf("read %q %q, expected %q %q", key, value, record[0], record[1])
+		}
+	}
+	if _, _, err := reader.Next(); err != io.EOF {
+		t.Fatalf("expected io.EOF after the last record, got %v", err)
+	}
+
+	//a record without its value
+	reader, err = NewBinaryReader(bytes.NewReader(output[:len(BinaryMagic)+2]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := reader.Next(); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected io.ErrUnexpectedEOF for a truncated record, got %v", err)
+	}
+}
+
+func TestBinaryFormatWithoutRecords(t *testing.T) {
+	var b bytes.Buffer
+	format, _ := Lookup(Binary)
+	if err := format.NewWriter(&b).Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if b.String() != BinaryMagic {
+		t.Fatalf("wrote %q without records", b.String())
+	}
+	reader, err := NewBinaryReader(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := reader.Next(); err != io.EOF {
+		t.Fatalf("expected io.EOF, got %v", err)
+	}
+	if _, err := NewBinaryReader(bytes.NewReader([]byte("a 1\n"))); err == nil {
+		t.Fatal("read a text output file as binary")
+	}
+}
+
+func TestLookupUnknownFormat(t *testing.T) {
+	if _, err := Lookup("xml"); err == nil {
+		t.Fatal("looked up an unknown format")
+	}
+}
@@ -2,9 +2,10 @@ package simple
 
 import (
 	"fmt"
+	"gomr.com/gomr/input"
 	"gomr.com/gomr/mr"
 	"gomr.com/gomr/utils"
-	"io/ioutil"
+	"io"
 	"log"
 	"os"
 	"sort"
@@ -18,25 +19,41 @@ func SimpleMapReduce()  {
 
 	exec_file := os.Args[1]
 
-	mapf, reducef := utils.LoadPlugin(exec_file)
+	p := utils.LoadPlugin(exec_file)
+	mapf, reducef := p.Map, p.Reduce
 
 	intermediate := []mr.KeyValue{}
 
-	for _, filename := range os.Args[2:] {
-		file, err := os.Open(filename)
-		if err != nil {
-			log.Fatalf("cannot open file: %v", filename)
-		}
-		content, err := ioutil.ReadAll(file)
+	inputFormat, err := input.Lookup(p.InputFormat)
+	if err != nil {
+		log.Fatalf("cannot use the input format, err: %v", err)
+	}
+	files, err := input.ExpandPaths(os.Args[2:])
+	if err != nil {
+		log.Fatalf("cannot expand the input paths, err: %v", err)
+	}
+	splits, err := inputFormat.Splits(files, input.DefaultSplitSize)
+	if err != nil {
+		log.Fatalf("cannot split the input files, err: %v", err)
+	}
 
+	for _, split := range splits {
+		records, err := inputFormat.Open(split)
 		if err != nil {
-			log.Fatalf("cannot read file: %v", filename)
+			log.Fatalf("cannot open split: %v, err: %v", split, err)
 		}
-
-		file.Close()
-
-		kva := mapf(filename, string(content))
-		intermediate = append(intermediate, kva...)
+		for {
+			key, value, err := records.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				log.Fatalf("cannot read split: %v, err: %v", split, err)
+			}
+			kva := mapf(key, value)
+			intermediate = append(intermediate, kva...)
+		}
+		records.Close()
 	}
 
 	sort.Sort(mr.SortKey(intermediate))
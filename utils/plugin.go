@@ -1,42 +1,110 @@
 package utils
 
 import (
+	"fmt"
 	"gomr.com/gomr/mr"
 	"log"
 	"plugin"
 )
 
+/**
+The operations loaded from a Map/Reduce plugin.
+*/
+type Plugin struct {
+	Map    func(string, string) []mr.KeyValue
+	Reduce func(string, []string) string
+
+	//optional, combines the values of a key on the map side before the shuffle, nil if not exported.
+	//Its output is fed to Combine again and finally to Reduce as one of the values of the key.
+	Combine func(string, []string) string
+
+	//optional, returns the reduce task in [0, nReduce) of a key, nil if not exported
+	Partition func(string, int) int
+
+	//optional, name of the input format for the job, exported as `var InputFormat = "lines"`
+	InputFormat string
+}
+
 /**
 Loads the Map and Reduce functions from the given executing file.
 It uses Plugin Library to parse and extract go functions from the executable.
 
 input: filename of go executable with Map/Reduce functions
-output:
+output: the Plugin with
  1. the Map function (string,string) -> []KeyValue
  2. Reduce Function (string, []string) -> string
+ 3. the optional Combine Function (string, []string) -> string
+ 4. the optional Partition Function (key string, nReduce int) -> int
+ 5. the optional InputFormat name
+*/
+func LoadPlugin(filename string) *Plugin {
+	loaded, err := OpenPlugin(filename)
+
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	return loaded
+}
+
+/**
+Loads the plugin like LoadPlugin, but returns an error instead of stopping the process,
+e.g. for the plugins of the jobs submitted to a long running controller.
 */
-func LoadPlugin(filename string) (func(string, string) []mr.KeyValue, func(string, []string) string) {
+func OpenPlugin(filename string) (*Plugin, error) {
 	p, err := plugin.Open(filename)
 
 	if err != nil {
-		log.Fatalf( "cannot log plugin %v, err: %v" , filename, err)
+		return nil, fmt.Errorf( "cannot log plugin %v, err: %v" , filename, err)
 	}
 
 	xmapf, err := p.Lookup("Map")
 
 	if err != nil {
-		log.Fatalf("cannot find Map in %v", filename)
+		return nil, fmt.Errorf("cannot find Map in %v", filename)
 	}
 
-	mapf := xmapf.(func(string, string) []mr.KeyValue)
+	mapf, ok := xmapf.(func(string, string) []mr.KeyValue)
+	if !ok {
+		return nil, fmt.Errorf("Map in %v must be a func(string, string) []mr.KeyValue", filename)
+	}
 
 	xreducef, err := p.Lookup("Reduce")
 	if err != nil {
-		log.Fatalf("cannot find Reduce in %v", filename)
+		return nil, fmt.Errorf("cannot find Reduce in %v", filename)
+	}
+
+	reducef, ok := xreducef.(func(string, []string) string)
+	if !ok {
+		return nil, fmt.Errorf("Reduce in %v must be a func(string, []string) string", filename)
 	}
 
-	reducef := xreducef.(func(string, []string) string)
+	loaded := &Plugin{Map: mapf, Reduce: reducef}
+
+	if xcombinef, err := p.Lookup("Combine"); err == nil {
+		combinef, ok := xcombinef.(func(string, []string) string)
+		if !ok {
+			return nil, fmt.Errorf("Combine in %v must be a func(string, []string) string", filename)
+		}
+		loaded.Combine = combinef
+	}
+
+	if xpartitionf, err := p.Lookup("Partition"); err == nil {
+		partitionf, ok := xpartitionf.(func(string, int) int)
+		if !ok {
+			return nil, fmt.Errorf("Partition in %v must be a func(string, int) int", filename)
+		}
+		loaded.Partition = partitionf
+	}
+
+	if xinputFormat, err := p.Lookup("InputFormat"); err == nil {
+		inputFormat, ok := xinputFormat.(*string)
+		if !ok {
+			return nil, fmt.Errorf("InputFormat in %v must be a string variable", filename)
+		}
+		loaded.InputFormat = *inputFormat
+	}
 
-	return mapf, reducef
+	return loaded, nil
 
 }